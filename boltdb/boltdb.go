@@ -0,0 +1,792 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/ellenkorbes/chatty/migrate"
+	"github.com/ellenkorbes/chatty/store"
+	"github.com/ellenkorbes/chatty/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DBObject carries the bbolt database handle and serves to inject all the code below.
+type DBObject struct {
+	DB *bolt.DB
+}
+
+// Bucket names. The usernames bucket maps each username to its user ID, and doubles as our unique index. The inbox and outbox buckets index messages by recipient and by sender, the unread bucket is the part of the inbox that hasn't been read yet, and the replies bucket indexes messages by the message they reply to, see indexKey. The ledger bucket keeps budget changes, keyed the same way by user ID.
+var (
+	usersBucket      = []byte("users")
+	usernamesBucket  = []byte("usernames")
+	messagesBucket   = []byte("messages")
+	inboxBucket      = []byte("inbox")
+	outboxBucket     = []byte("outbox")
+	unreadBucket     = []byte("unread")
+	repliesBucket    = []byte("replies")
+	ledgerBucket     = []byte("ledger")
+	migrationsBucket = []byte("migrations")
+)
+
+// Making sure we keep up with the interfaces.
+var (
+	_ store.UserStore    = DBObject{}
+	_ store.MessageStore = DBObject{}
+	_ migrate.Store      = DBObject{}
+)
+
+// NewSession opens the database file at path, creating it and its buckets if this is the first start.
+func NewSession(path string) (DBObject, error) {
+	d, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return DBObject{}, err
+	}
+	err = d.Update(func(tx *bolt.Tx) error {
+		// A file without users is one we've just created, and it's born up to date.
+		fresh := tx.Bucket(usersBucket) == nil
+		for _, b := range [][]byte{usersBucket, usernamesBucket, messagesBucket, inboxBucket, outboxBucket, unreadBucket, repliesBucket, ledgerBucket, migrationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if !fresh {
+			return nil
+		}
+		for _, m := range (DBObject{d}).Migrations() {
+			if err := setApplied(tx, m.Version, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		d.Close()
+		return DBObject{}, err
+	}
+	return DBObject{d}, nil
+}
+
+// Close closes the database file.
+func (db DBObject) Close() {
+	db.DB.Close()
+}
+
+// AddUser stores a new user. Users without an ID get a new one.
+func (db DBObject) AddUser(ctx context.Context, user *types.User) error {
+	if user.ID == "" {
+		user.ID = types.NewID()
+	}
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		users, usernames := tx.Bucket(usersBucket), tx.Bucket(usernamesBucket)
+		if users.Get([]byte(user.ID)) != nil {
+			return store.ErrConflict
+		}
+		if usernames.Get([]byte(user.Username)) != nil {
+			return store.ErrDuplicate
+		}
+		if err := usernames.Put([]byte(user.Username), []byte(user.ID)); err != nil {
+			return err
+		}
+		if err := put(users, string(user.ID), *user); err != nil {
+			return err
+		}
+		return record(tx, *user, types.LedgerEntry{Amount: user.Budget, Reason: types.ReasonOpen, CreatedAt: user.CreatedAt})
+	})
+}
+
+// GetUserByID gets a user by ID.
+func (db DBObject) GetUserByID(ctx context.Context, id types.ID) (types.User, error) {
+	data := types.User{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return get(tx.Bucket(usersBucket), string(id), &data)
+	})
+	if err != nil {
+		return types.User{}, err
+	}
+	return data, nil
+}
+
+// GetUser gets the full User object for a username.
+func (db DBObject) GetUser(ctx context.Context, user string) (types.User, error) {
+	data := types.User{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return getUser(tx, user, &data)
+	})
+	if err != nil {
+		return types.User{}, err
+	}
+	return data, nil
+}
+
+// ListUsers gets every user, oldest first.
+func (db DBObject) ListUsers(ctx context.Context) ([]types.User, error) {
+	all := []types.User{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			user := types.User{}
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			all = append(all, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// IsUnique checks whether a username is already present in the database.
+func (db DBObject) IsUnique(ctx context.Context, user types.User) (bool, error) {
+	unique := false
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		unique = tx.Bucket(usernamesBucket).Get([]byte(user.Username)) == nil
+		return nil
+	})
+	return unique, err
+}
+
+// UpdateUser changes a user's name and username, and returns the user. A new username carries over to every message they've sent or received, and to their entries in the message indexes, all in the same transaction. Renames are rare, so this goes through every message, tombstones included.
+func (db DBObject) UpdateUser(ctx context.Context, id types.ID, name string, username string, at time.Time) (types.User, error) {
+	user := types.User{}
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		if err := get(tx.Bucket(usersBucket), string(id), &user); err != nil {
+			return err
+		}
+		if user.DeactivatedAt != nil {
+			return store.ErrConflict
+		}
+		if old := user.Username; username != old {
+			usernames := tx.Bucket(usernamesBucket)
+			if usernames.Get([]byte(username)) != nil {
+				return store.ErrDuplicate
+			}
+			if err := usernames.Delete([]byte(old)); err != nil {
+				return err
+			}
+			if err := usernames.Put([]byte(username), []byte(id)); err != nil {
+				return err
+			}
+			if err := rename(tx, old, username); err != nil {
+				return err
+			}
+		}
+		user.Name, user.Username, user.UpdatedAt = name, username, at
+		return put(tx.Bucket(usersBucket), string(id), user)
+	})
+	if err != nil {
+		return types.User{}, err
+	}
+	return user, nil
+}
+
+// DeactivateUser deactivates a user, and returns it.
+func (db DBObject) DeactivateUser(ctx context.Context, id types.ID, at time.Time) (types.User, error) {
+	user := types.User{}
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		if err := get(tx.Bucket(usersBucket), string(id), &user); err != nil {
+			return err
+		}
+		if user.DeactivatedAt != nil {
+			return store.ErrConflict
+		}
+		user.DeactivatedAt, user.UpdatedAt = &at, at
+		return put(tx.Bucket(usersBucket), string(id), user)
+	})
+	if err != nil {
+		return types.User{}, err
+	}
+	return user, nil
+}
+
+// SetBudget sets a user's budget and when it next resets, as long as both are still what they are in the given user, and returns the user.
+func (db DBObject) SetBudget(ctx context.Context, old types.User, budget int, resetsAt *time.Time) (types.User, error) {
+	user := types.User{}
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		if err := get(tx.Bucket(usersBucket), string(old.ID), &user); err != nil {
+			return err
+		}
+		if user.Budget != old.Budget || !store.SameTime(user.BudgetResetsAt, old.BudgetResetsAt) {
+			return store.ErrConflict
+		}
+		amount := budget - user.Budget
+		user.Budget, user.BudgetResetsAt = budget, resetsAt
+		if err := put(tx.Bucket(usersBucket), string(old.ID), user); err != nil {
+			return err
+		}
+		if amount == 0 {
+			return nil
+		}
+		return record(tx, user, types.LedgerEntry{Amount: amount, Reason: types.ReasonRefill, CreatedAt: time.Now()})
+	})
+	if err != nil {
+		return types.User{}, err
+	}
+	return user, nil
+}
+
+// GrantBudget adds to a user's budget, or takes away when negative, and returns the user.
+func (db DBObject) GrantBudget(ctx context.Context, id types.ID, amount int, note string, at time.Time) (types.User, error) {
+	user := types.User{}
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		if err := get(tx.Bucket(usersBucket), string(id), &user); err != nil {
+			return err
+		}
+		switch {
+		case user.DeactivatedAt != nil:
+			return store.ErrConflict
+		case user.Budget+amount < 0:
+			return store.ErrBudgetExhausted
+		}
+		user.Budget += amount
+		user.UpdatedAt = at
+		if err := put(tx.Bucket(usersBucket), string(id), user); err != nil {
+			return err
+		}
+		return record(tx, user, types.LedgerEntry{Amount: amount, Reason: types.ReasonGrant, Note: note, CreatedAt: at})
+	})
+	if err != nil {
+		return types.User{}, err
+	}
+	return user, nil
+}
+
+// Ledger gets every change to a user's budget, oldest first.
+func (db DBObject) Ledger(ctx context.Context, id types.ID) ([]types.LedgerEntry, error) {
+	entries := []types.LedgerEntry{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get([]byte(id)) == nil {
+			return store.ErrNotFound
+		}
+		prefix := append([]byte(id), 0)
+		c := tx.Bucket(ledgerBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			entry := types.LedgerEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SendMessage charges the sender the message's cost and stores the message in a single transaction. Senders who can't afford it get store.ErrBudgetExhausted and nothing is stored.
+func (db DBObject) SendMessage(ctx context.Context, message *types.Message) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		sender := types.User{}
+		if err := getUser(tx, message.From, &sender); err != nil {
+			return err
+		}
+		if sender.Budget < message.Cost {
+			return store.ErrBudgetExhausted
+		}
+		if message.ID == "" {
+			message.ID = types.NewID()
+		}
+		messages := tx.Bucket(messagesBucket)
+		if messages.Get([]byte(message.ID)) != nil {
+			return store.ErrConflict
+		}
+		sender.Budget -= message.Cost
+		sender.UpdatedAt = time.Now()
+		if err := put(tx.Bucket(usersBucket), string(sender.ID), sender); err != nil {
+			return err
+		}
+		if err := record(tx, sender, types.LedgerEntry{Amount: -message.Cost, Reason: types.ReasonSend, MessageID: message.ID, CreatedAt: sender.UpdatedAt}); err != nil {
+			return err
+		}
+		if err := put(messages, string(message.ID), *message); err != nil {
+			return err
+		}
+		if message.ReplyTo != "" {
+			if err := tx.Bucket(repliesBucket).Put(indexKey(string(message.ReplyTo), message.SentAt, message.ID), []byte{}); err != nil {
+				return err
+			}
+		}
+		if message.ReadAt == nil {
+			if err := tx.Bucket(unreadBucket).Put(indexKey(message.To, message.SentAt, message.ID), []byte{}); err != nil {
+				return err
+			}
+		}
+		return index(tx, *message)
+	})
+}
+
+// GetMessage gets a message by ID.
+func (db DBObject) GetMessage(ctx context.Context, id types.ID) (types.Message, error) {
+	data := types.Message{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return get(tx.Bucket(messagesBucket), string(id), &data)
+	})
+	if err != nil {
+		return types.Message{}, err
+	}
+	return data, nil
+}
+
+// ListMessages gets every message, oldest first.
+func (db DBObject) ListMessages(ctx context.Context) ([]types.Message, error) {
+	all := []types.Message{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			message := types.Message{}
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			all = append(all, message)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// FindMessages gets a page of the messages matching a query. Queries by recipient or sender walk the inbox or outbox index, starting from the time range and cursor, and stop as soon as the page is full.
+func (db DBObject) FindMessages(ctx context.Context, q store.MessageQuery) (types.Messages, error) {
+	sm := []types.Message{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		switch {
+		case q.EitherWay && q.To != "" && q.From != "" && q.To != q.From:
+			// One inbox for each way. Page puts them together.
+			if err := scan(ctx, tx, inboxBucket, q.To, q, &sm); err != nil {
+				return err
+			}
+			other := []types.Message{}
+			if err := scan(ctx, tx, inboxBucket, q.From, q, &other); err != nil {
+				return err
+			}
+			sm = append(sm, other...)
+			return nil
+		case q.To != "" && q.Unread:
+			return scan(ctx, tx, unreadBucket, q.To, q, &sm)
+		case q.To != "":
+			return scan(ctx, tx, inboxBucket, q.To, q, &sm)
+		case q.From != "":
+			return scan(ctx, tx, outboxBucket, q.From, q, &sm)
+		}
+		// No index to go on. Messages are keyed by ID rather than by SentAt, so this goes through all of them.
+		return tx.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			message := types.Message{}
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			if q.Matches(message) {
+				sm = append(sm, message)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return types.Messages{}, err
+	}
+	return q.Page(sm), nil
+}
+
+// Conversations sums up everyone a username has exchanged messages with, most recent first, going through their inbox and outbox.
+func (db DBObject) Conversations(ctx context.Context, username string) ([]types.Conversation, error) {
+	sm := []types.Message{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		if err := scan(ctx, tx, inboxBucket, username, store.MessageQuery{}, &sm); err != nil {
+			return err
+		}
+		// Messages to oneself are in both, and they only count once.
+		sent := []types.Message{}
+		if err := scan(ctx, tx, outboxBucket, username, store.MessageQuery{From: username}, &sent); err != nil {
+			return err
+		}
+		for _, m := range sent {
+			if m.To != username {
+				sm = append(sm, m)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store.Summarize(username, sm), nil
+}
+
+// Replies gets every direct reply to any of the messages, oldest first.
+func (db DBObject) Replies(ctx context.Context, ids []types.ID) ([]types.Message, error) {
+	sm := []types.Message{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			if err := scan(ctx, tx, repliesBucket, string(id), store.MessageQuery{}, &sm); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sm, func(i, j int) bool { return store.Less(sm[i], sm[j]) })
+	return sm, nil
+}
+
+// DeliverMessages records when messages showed up in their recipient's inbox, for the ones that hadn't yet.
+func (db DBObject) DeliverMessages(ctx context.Context, ids []types.ID, at time.Time) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		messages := tx.Bucket(messagesBucket)
+		for _, id := range ids {
+			message := types.Message{}
+			if err := get(messages, string(id), &message); err != nil {
+				return err
+			}
+			if message.DeliveredAt != nil {
+				continue
+			}
+			message.DeliveredAt = &at
+			if err := put(messages, string(id), message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReadMessage records when the recipient read a message, unless they already had, and returns it. Reading a message delivers it too.
+func (db DBObject) ReadMessage(ctx context.Context, id types.ID, at time.Time) (types.Message, error) {
+	message := types.Message{}
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		if err := get(tx.Bucket(messagesBucket), string(id), &message); err != nil {
+			return err
+		}
+		return markRead(tx, &message, at)
+	})
+	if err != nil {
+		return types.Message{}, err
+	}
+	return message, nil
+}
+
+// ReadMessages records when the recipient read every unread message matching a query, and says how many there were. Queries by recipient only go through what's left unread of their inbox.
+func (db DBObject) ReadMessages(ctx context.Context, q store.MessageQuery, at time.Time) (int, error) {
+	q.Unread, q.Limit, q.After = true, 0, nil
+	count := 0
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		sm := []types.Message{}
+		if q.To != "" && !q.EitherWay {
+			if err := scan(ctx, tx, unreadBucket, q.To, q, &sm); err != nil {
+				return err
+			}
+		} else {
+			err := tx.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+				message := types.Message{}
+				if err := json.Unmarshal(v, &message); err != nil {
+					return err
+				}
+				if q.Matches(message) {
+					sm = append(sm, message)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for i := range sm {
+			if err := markRead(tx, &sm[i], at); err != nil {
+				return err
+			}
+		}
+		count = len(sm)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountUnread counts the messages a username hasn't read yet, without loading any of them.
+func (db DBObject) CountUnread(ctx context.Context, username string) (int, error) {
+	count := 0
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		prefix := append([]byte(username), 0)
+		c := tx.Bucket(unreadBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// EditMessage replaces the body of a message, keeping the old one in its revisions, and returns it.
+func (db DBObject) EditMessage(ctx context.Context, id types.ID, body string, at time.Time) (types.Message, error) {
+	message := types.Message{}
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		messages := tx.Bucket(messagesBucket)
+		if err := get(messages, string(id), &message); err != nil {
+			return err
+		}
+		if message.DeletedAt != nil {
+			return store.ErrConflict
+		}
+		written := message.SentAt
+		if message.EditedAt != nil {
+			written = *message.EditedAt
+		}
+		message.Revisions = append(message.Revisions, types.Revision{Body: message.Body, WrittenAt: written})
+		message.Body, message.EditedAt = body, &at
+		return put(messages, string(id), message)
+	})
+	if err != nil {
+		return types.Message{}, err
+	}
+	return message, nil
+}
+
+// DeleteMessage turns a message into a tombstone: its body and revisions go, and so do its entries in the inbox, outbox, and unread indexes. It stays in the replies index, so reply trees keep their shape.
+func (db DBObject) DeleteMessage(ctx context.Context, id types.ID, at time.Time) (types.Message, error) {
+	message := types.Message{}
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		if err := get(tx.Bucket(messagesBucket), string(id), &message); err != nil {
+			return err
+		}
+		if message.DeletedAt != nil {
+			return store.ErrConflict
+		}
+		message.Body, message.Revisions, message.EditedAt, message.DeletedAt = "", nil, nil, &at
+		if err := put(tx.Bucket(messagesBucket), string(id), message); err != nil {
+			return err
+		}
+		for _, index := range [][]byte{inboxBucket, unreadBucket} {
+			if err := tx.Bucket(index).Delete(indexKey(message.To, message.SentAt, message.ID)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(outboxBucket).Delete(indexKey(message.From, message.SentAt, message.ID))
+	})
+	if err != nil {
+		return types.Message{}, err
+	}
+	return message, nil
+}
+
+// markRead marks a message as read, and delivered, at the time given, and takes it out of the unread index. Messages already read stay as they were.
+func markRead(tx *bolt.Tx, message *types.Message, at time.Time) error {
+	if message.ReadAt != nil {
+		return nil
+	}
+	if message.DeliveredAt == nil {
+		message.DeliveredAt = &at
+	}
+	message.ReadAt = &at
+	if err := put(tx.Bucket(messagesBucket), string(message.ID), *message); err != nil {
+		return err
+	}
+	return tx.Bucket(unreadBucket).Delete(indexKey(message.To, message.SentAt, message.ID))
+}
+
+// indexKey returns the key of a message in the inbox or outbox index of a username, or in the replies index of a message ID: the username or ID, a zero byte, the time it was sent, and its ID. Keys sort the way listings do, by SentAt and then by ID, and every key for a username shares the same prefix. Leaving the ID blank gives where a moment in time starts.
+func indexKey(username string, sentAt time.Time, id types.ID) []byte {
+	key := make([]byte, len(username)+9, len(username)+9+len(id))
+	copy(key, username)
+	// Flipping the sign bit, so times before 1970 still sort first.
+	binary.BigEndian.PutUint64(key[len(username)+1:], uint64(sentAt.UnixNano())^1<<63)
+	return append(key, id...)
+}
+
+// record adds an entry to a user's ledger, for a change that's already been made to their budget. The entry gets its ID, user ID, and balance from here.
+func record(tx *bolt.Tx, user types.User, entry types.LedgerEntry) error {
+	entry.ID, entry.UserID, entry.Balance = types.NewID(), user.ID, user.Budget
+	return put(tx.Bucket(ledgerBucket), string(indexKey(string(user.ID), entry.CreatedAt, entry.ID)), entry)
+}
+
+// index adds a message to the inbox index of its recipient and the outbox index of its sender. Tombstones stay out of both.
+func index(tx *bolt.Tx, message types.Message) error {
+	if message.DeletedAt != nil {
+		return nil
+	}
+	if err := tx.Bucket(inboxBucket).Put(indexKey(message.To, message.SentAt, message.ID), []byte{}); err != nil {
+		return err
+	}
+	return tx.Bucket(outboxBucket).Put(indexKey(message.From, message.SentAt, message.ID), []byte{})
+}
+
+// rename moves every message from or to one username over to another, along with its entries in the inbox, outbox, and unread indexes.
+func rename(tx *bolt.Tx, old string, username string) error {
+	prefix := append([]byte(old), 0)
+	for _, index := range [][]byte{inboxBucket, outboxBucket, unreadBucket} {
+		b := tx.Bucket(index)
+		// Keys are collected first, since bolt doesn't like buckets changing under its cursors.
+		keys := [][]byte{}
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			if err := b.Put(append([]byte(username), k[len(old):]...), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	messages := tx.Bucket(messagesBucket)
+	renamed := []types.Message{}
+	err := messages.ForEach(func(k, v []byte) error {
+		message := types.Message{}
+		if err := json.Unmarshal(v, &message); err != nil {
+			return err
+		}
+		if message.From != old && message.To != old {
+			return nil
+		}
+		if message.From == old {
+			message.From = username
+		}
+		if message.To == old {
+			message.To = username
+		}
+		renamed = append(renamed, message)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, message := range renamed {
+		if err := put(messages, string(message.ID), message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan walks the entries for username in an index, within the query's time range and after its cursor, in the query's order. The messages matching the rest of the query go into saveTo, up to one more than Limit, so Page can tell whether there's a next page.
+func scan(ctx context.Context, tx *bolt.Tx, index []byte, username string, q store.MessageQuery, saveTo *[]types.Message) error {
+	// Every key in [lo, hi) is one we're after.
+	lo, hi := append([]byte(username), 0), append([]byte(username), 1)
+	if !q.Since.IsZero() {
+		lo = indexKey(username, q.Since, "")
+	}
+	if !q.Until.IsZero() {
+		hi = indexKey(username, q.Until, "")
+	}
+	if q.Through != nil {
+		if through := append(indexKey(username, q.Through.SentAt, q.Through.ID), 0); bytes.Compare(through, hi) < 0 {
+			hi = through
+		}
+	}
+	if q.After != nil {
+		after := indexKey(username, q.After.SentAt, q.After.ID)
+		if q.Descending && bytes.Compare(after, hi) < 0 {
+			hi = after
+		}
+		if after = append(after, 0); !q.Descending && bytes.Compare(after, lo) > 0 {
+			lo = after
+		}
+	}
+	messages, c := tx.Bucket(messagesBucket), tx.Bucket(index).Cursor()
+	var k []byte
+	next := c.Next
+	if !q.Descending {
+		k, _ = c.Seek(lo)
+	} else {
+		next = c.Prev
+		// Seek lands on the first key at or after hi, so the one we want is right before it.
+		if k, _ = c.Seek(hi); k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+	}
+	for ; k != nil && bytes.Compare(k, lo) >= 0 && bytes.Compare(k, hi) < 0; k, _ = next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		message := types.Message{}
+		if err := get(messages, string(k[len(username)+9:]), &message); err != nil {
+			return err
+		}
+		if !q.Matches(message) {
+			continue
+		}
+		*saveTo = append(*saveTo, message)
+		if q.Limit > 0 && len(*saveTo) > q.Limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// view runs fn in a read-only transaction, unless ctx is already done. If ctx runs out while fn is busy, whatever fn found is thrown away and the context's error returned instead.
+func (db DBObject) view(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.DB.View(func(tx *bolt.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+// update runs fn in a read-write transaction, unless ctx is already done. Only one of those runs at a time, so ctx is checked again once the transaction is ours, and if ctx runs out while fn is busy, the transaction is rolled back.
+func (db DBObject) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.DB.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+// getUser looks up a username in the usernames index and loads the matching user into saveTo.
+func getUser(tx *bolt.Tx, username string, saveTo *types.User) error {
+	id := tx.Bucket(usernamesBucket).Get([]byte(username))
+	if id == nil {
+		return store.ErrNotFound
+	}
+	return get(tx.Bucket(usersBucket), string(id), saveTo)
+}
+
+// get decodes the value stored under key into saveTo.
+func get(b *bolt.Bucket, key string, saveTo interface{}) error {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return store.ErrNotFound
+	}
+	return json.Unmarshal(v, saveTo)
+}
+
+// put stores value under key. Values are passed by value on purpose: this keeps the MarshalJSON hacks in the types package, which round times to the millisecond, out of the way.
+func put(b *bolt.Bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
@@ -0,0 +1,849 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ellenkorbes/chatty/migrate"
+	"github.com/ellenkorbes/chatty/store"
+	"github.com/ellenkorbes/chatty/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testSession opens a database file in a temporary directory that goes away once the test is over.
+func testSession(t *testing.T) DBObject {
+	d, err := NewSession(filepath.Join(t.TempDir(), "chatty.db"))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	t.Cleanup(d.Close)
+	return d
+}
+
+// TestNewSessionMigrations tests that a new file starts out with every migration applied, and that reopening an existing one leaves its migrations as they were.
+func TestNewSessionMigrations(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "chatty.db")
+	d, err := NewSession(file)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	ctx := context.Background()
+	if pending, err := migrate.Pending(ctx, d); err != nil || pending != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", pending, err, 0, nil))
+	}
+	// As if it were from before the latest migration.
+	latest := d.Migrations()[len(d.Migrations())-1].Version
+	if err := d.SetApplied(ctx, latest, false); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	d.Close()
+	if d, err = NewSession(file); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	defer d.Close()
+	if pending, err := migrate.Pending(ctx, d); err != nil || pending != 1 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", pending, err, 1, nil))
+	}
+}
+
+// TestFindMessages tests that walking the inbox, outbox and unread indexes page by page gives the same results as checking every message, for all sorts of filter combinations.
+func TestFindMessages(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	usernames := []string{"apple", "banana", "orange"}
+	for _, username := range usernames {
+		user := types.User{Name: username, Username: username, Budget: 1000, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	// Lots of messages sent within a few seconds, so plenty of them share a timestamp. Some of them have been read already.
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		message := types.Message{
+			From:   usernames[r.Intn(len(usernames))],
+			To:     usernames[r.Intn(len(usernames))],
+			Body:   fmt.Sprint("Message ", i),
+			SentAt: start.Add(time.Duration(r.Intn(10)) * time.Second),
+		}
+		if r.Intn(3) == 0 {
+			read := start.Add(time.Minute)
+			message.ReadAt = &read
+		}
+		if err := d.SendMessage(ctx, &message); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	all, err := d.ListMessages(ctx)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	through := store.CursorOf(all[len(all)/2])
+	queries := []store.MessageQuery{
+		{To: "banana"},
+		{To: "banana", Unread: true},
+		{To: "orange", Unread: true, Descending: true, Since: start.Add(3 * time.Second)},
+		{To: "apple", From: "orange", Unread: true},
+		{To: "apple", Through: &through},
+		{To: "orange", Unread: true, Through: &through, Descending: true},
+		{From: "banana", Through: &through},
+		{From: "banana", Descending: true},
+		{To: "banana", From: "orange"},
+		{To: "banana", From: "orange", EitherWay: true},
+		{To: "apple", From: "apple", EitherWay: true, Descending: true},
+		{To: "orange", From: "apple", EitherWay: true, Since: start.Add(4 * time.Second)},
+		{To: "apple", Since: start.Add(3 * time.Second)},
+		{From: "apple", Until: start.Add(5 * time.Second), Descending: true},
+		{To: "orange", Since: start.Add(2 * time.Second), Until: start.Add(7 * time.Second)},
+		{From: "orange", Since: start.Add(-time.Hour), Until: start.Add(time.Hour)},
+		{To: "apple", Since: start.Add(time.Hour)},
+		{To: "kiwi"},
+		{},
+	}
+	for _, q := range queries {
+		// What the results should be, straight from every message.
+		expected := []types.ID{}
+		matches := []types.Message{}
+		for _, m := range all {
+			if q.Matches(m) {
+				matches = append(matches, m)
+			}
+		}
+		for _, m := range q.Page(matches).Entries {
+			expected = append(expected, m.ID)
+		}
+		for _, limit := range []int{0, 1, 7, 1000} {
+			q.Limit, q.After = limit, nil
+			actual := []types.ID{}
+			for pages := 0; ; pages++ {
+				page, err := d.FindMessages(ctx, q)
+				if err != nil || pages > len(all) {
+					t.Fatal(fmt.Sprintf("%+v\tActual: %v\tExpected: %v", q, err, nil))
+				}
+				for _, m := range page.Entries {
+					actual = append(actual, m.ID)
+				}
+				if page.Next == "" {
+					break
+				}
+				after, err := store.ParseCursor(page.Next)
+				if err != nil {
+					t.Fatal(fmt.Sprintln("Unknown error:", err))
+				}
+				q.After = &after
+			}
+			if fmt.Sprint(actual) != fmt.Sprint(expected) {
+				t.Error(fmt.Sprintf("%+v\tActual: %d messages\tExpected: %d messages, in the same order", q, len(actual), len(expected)))
+			}
+		}
+	}
+}
+
+// TestIndexMessages tests that the indexing migration brings back indexes that have gone missing.
+func TestIndexMessages(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now()}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if err := d.dropMessageIndexes(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if inbox, err := d.FindMessages(ctx, store.MessageQuery{To: "banana"}); err != nil || len(inbox.Entries) != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", len(inbox.Entries), err, 0, nil))
+	}
+	if err := d.indexMessages(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	for _, q := range []store.MessageQuery{{To: "banana"}, {From: "orange"}} {
+		messages, err := d.FindMessages(ctx, q)
+		if err != nil || len(messages.Entries) != 1 || messages.Entries[0].ID != message.ID {
+			t.Error(fmt.Sprintf("%+v\tActual: %v - %v\tExpected: [%s] - %v", q, messages.Entries, err, message.ID, nil))
+		}
+	}
+}
+
+// TestConversations tests that conversations come out the same as when summing up every message, with messages to oneself counted once.
+func TestConversations(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"apple", "banana", "orange"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	read := time.Now()
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	sent := []types.Message{
+		{From: "banana", To: "orange", Body: "Hi.", SentAt: start},
+		{From: "orange", To: "banana", Body: "Hi!", SentAt: start.Add(time.Second)},
+		{From: "apple", To: "orange", Body: "Psst.", SentAt: start.Add(2 * time.Second), ReadAt: &read},
+		{From: "orange", To: "orange", Body: "Note to self.", SentAt: start.Add(3 * time.Second)},
+		{From: "banana", To: "orange", Body: "You there?", SentAt: start.Add(4 * time.Second)},
+		{From: "banana", To: "apple", Body: "Not you.", SentAt: start.Add(5 * time.Second)},
+	}
+	for i := range sent {
+		if err := d.SendMessage(ctx, &sent[i]); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	conversations, err := d.Conversations(ctx, "orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	expected := []types.Conversation{
+		{With: "banana", Last: sent[4], Unread: 2},
+		{With: "orange", Last: sent[3], Unread: 1},
+		{With: "apple", Last: sent[2], Unread: 0},
+	}
+	if len(conversations) != len(expected) {
+		t.Fatal(fmt.Sprintf("Actual: %v\tExpected: %v", conversations, expected))
+	}
+	for i, c := range conversations {
+		if c.With != expected[i].With || c.Last.ID != expected[i].Last.ID || c.Unread != expected[i].Unread {
+			t.Error(fmt.Sprintf("Actual: %s - %s - %d\tExpected: %s - %s - %d", c.With, c.Last.ID, c.Unread, expected[i].With, expected[i].Last.ID, expected[i].Unread))
+		}
+	}
+}
+
+// TestReplies tests that replies to several messages come out together, oldest first, leaving out replies to anything else.
+func TestReplies(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	sent := []types.Message{
+		{From: "orange", To: "banana", Body: "First.", SentAt: start},
+		{From: "orange", To: "banana", Body: "Second.", SentAt: start.Add(time.Second)},
+		{From: "orange", To: "banana", Body: "Third.", SentAt: start.Add(2 * time.Second)},
+	}
+	for i := range sent {
+		if err := d.SendMessage(ctx, &sent[i]); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	// Sent in no particular order.
+	replies := []types.Message{
+		{From: "banana", To: "orange", Body: "Re: second.", SentAt: start.Add(5 * time.Second), ReplyTo: sent[1].ID},
+		{From: "banana", To: "orange", Body: "Re: first.", SentAt: start.Add(4 * time.Second), ReplyTo: sent[0].ID},
+		{From: "banana", To: "orange", Body: "Re: third.", SentAt: start.Add(3 * time.Second), ReplyTo: sent[2].ID},
+	}
+	for i := range replies {
+		if err := d.SendMessage(ctx, &replies[i]); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	actual, err := d.Replies(ctx, []types.ID{sent[1].ID, sent[0].ID})
+	if err != nil || len(actual) != 2 || actual[0].ID != replies[1].ID || actual[1].ID != replies[0].ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: [%s %s] - %v", actual, err, replies[1].ID, replies[0].ID, nil))
+	}
+}
+
+// TestReadMessages tests that marking messages as read takes them out of the unread index, up to the message given and no further, and leaves earlier read receipts alone.
+func TestReadMessages(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	sent := []types.Message{}
+	for i := 0; i < 5; i++ {
+		message := types.Message{From: "orange", To: "banana", Body: fmt.Sprint("Message ", i), SentAt: start.Add(time.Duration(i) * time.Second)}
+		if err := d.SendMessage(ctx, &message); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		sent = append(sent, message)
+	}
+	if count, err := d.CountUnread(ctx, "banana"); err != nil || count != 5 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 5, nil))
+	}
+	first := start.Add(time.Hour)
+	message, err := d.ReadMessage(ctx, sent[1].ID, first)
+	if err != nil || message.ReadAt == nil || !message.ReadAt.Equal(first) || message.DeliveredAt == nil {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", message.ReadAt, err, first, nil))
+	}
+	through := store.CursorOf(sent[2])
+	later := start.Add(2 * time.Hour)
+	if count, err := d.ReadMessages(ctx, store.MessageQuery{To: "banana", Through: &through}, later); err != nil || count != 2 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 2, nil))
+	}
+	if count, err := d.CountUnread(ctx, "banana"); err != nil || count != 2 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 2, nil))
+	}
+	if message, _ := d.GetMessage(ctx, sent[1].ID); message.ReadAt == nil || !message.ReadAt.Equal(first) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", message.ReadAt, first))
+	}
+	unread, err := d.FindMessages(ctx, store.MessageQuery{To: "banana", Unread: true})
+	if err != nil || len(unread.Entries) != 2 || unread.Entries[0].ID != sent[3].ID || unread.Entries[1].ID != sent[4].ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: [%s %s] - %v", unread.Entries, err, sent[3].ID, sent[4].ID, nil))
+	}
+	if _, err := d.ReadMessage(ctx, types.NewID(), later); err != store.ErrNotFound {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestEditMessage tests that edits keep every earlier body, each with when it was written, and that deleted messages can't be edited.
+func TestEditMessage(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: start}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	for i, body := range []string{"Hello.", "Hello there."} {
+		if _, err := d.EditMessage(ctx, message.ID, body, start.Add(time.Duration(i+1)*time.Minute)); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	edited, err := d.GetMessage(ctx, message.ID)
+	expected := []types.Revision{{Body: "Hi.", WrittenAt: start}, {Body: "Hello.", WrittenAt: start.Add(time.Minute)}}
+	if err != nil || edited.Body != "Hello there." || edited.EditedAt == nil || !edited.EditedAt.Equal(start.Add(2*time.Minute)) || fmt.Sprint(edited.Revisions) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Actual: %q - %v - %v - %v\tExpected: %q - %v - %v - %v", edited.Body, edited.EditedAt, edited.Revisions, err, "Hello there.", start.Add(2*time.Minute), expected, nil))
+	}
+	if _, err := d.DeleteMessage(ctx, message.ID, start.Add(time.Hour)); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.EditMessage(ctx, message.ID, "Too late.", start.Add(2*time.Hour)); err != store.ErrConflict {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	if _, err := d.EditMessage(ctx, types.NewID(), "Nobody.", start); err != store.ErrNotFound {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestDeleteMessage tests that a deleted message leaves a tombstone behind, which stays out of every listing and count but keeps its replies.
+func TestDeleteMessage(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	message := types.Message{From: "orange", To: "banana", Body: "Oops.", SentAt: start}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	reply := types.Message{From: "banana", To: "orange", Body: "What?", SentAt: start.Add(time.Second), ReplyTo: message.ID}
+	if err := d.SendMessage(ctx, &reply); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.EditMessage(ctx, message.ID, "Oops!", start.Add(time.Minute)); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	tombstone, err := d.DeleteMessage(ctx, message.ID, start.Add(time.Hour))
+	if err != nil || tombstone.Body != "" || tombstone.Revisions != nil || tombstone.EditedAt != nil || tombstone.DeletedAt == nil {
+		t.Error(fmt.Sprintf("Actual: %+v - %v\tExpected: a tombstone - %v", tombstone, err, nil))
+	}
+	if _, err := d.DeleteMessage(ctx, message.ID, start.Add(2*time.Hour)); err != store.ErrConflict {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	for _, q := range []store.MessageQuery{{To: "banana"}, {From: "orange"}, {To: "banana", Unread: true}, {To: "banana", From: "orange", EitherWay: true}, {}} {
+		messages, err := d.FindMessages(ctx, q)
+		for _, m := range messages.Entries {
+			if m.ID == message.ID || err != nil {
+				t.Error(fmt.Sprintf("%+v\tActual: %v - %v\tExpected: no tombstone - %v", q, messages.Entries, err, nil))
+			}
+		}
+	}
+	if count, err := d.CountUnread(ctx, "banana"); err != nil || count != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 0, nil))
+	}
+	if conversations, err := d.Conversations(ctx, "banana"); err != nil || len(conversations) != 1 || conversations[0].Last.ID != reply.ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: the reply as the last message - %v", conversations, err, nil))
+	}
+	if replies, err := d.Replies(ctx, []types.ID{message.ID}); err != nil || len(replies) != 1 || replies[0].ID != reply.ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: [%s] - %v", replies, err, reply.ID, nil))
+	}
+	// Indexing everything again doesn't bring it back.
+	if err := d.indexMessages(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if err := d.indexUnread(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if inbox, err := d.FindMessages(ctx, store.MessageQuery{To: "banana"}); err != nil || len(inbox.Entries) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", inbox.Entries, err, "[]", nil))
+	}
+	if count, err := d.CountUnread(ctx, "banana"); err != nil || count != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 0, nil))
+	}
+}
+
+// TestUpdateUser tests that a new username carries over to every message, listings and unread counts included, that taken usernames stay taken, and that deactivated users can't be changed.
+func TestUpdateUser(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	users := map[string]types.User{}
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		users[username] = user
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	sent := []types.Message{
+		{From: "orange", To: "banana", Body: "Hi.", SentAt: start, Cost: 1},
+		{From: "banana", To: "orange", Body: "Hi!", SentAt: start.Add(time.Second), Cost: 1},
+		{From: "orange", To: "orange", Body: "Note to self.", SentAt: start.Add(2 * time.Second), Cost: 1},
+		{From: "banana", To: "orange", Body: "Oops.", SentAt: start.Add(3 * time.Second), Cost: 1},
+	}
+	for i := range sent {
+		if err := d.SendMessage(ctx, &sent[i]); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	if _, err := d.DeleteMessage(ctx, sent[3].ID, start.Add(time.Minute)); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.UpdateUser(ctx, users["orange"].ID, "Orange", "banana", start); err != store.ErrDuplicate {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrDuplicate))
+	}
+	user, err := d.UpdateUser(ctx, users["orange"].ID, "Tangerine", "tangerine", start.Add(time.Hour))
+	if err != nil || user.Name != "Tangerine" || user.Username != "tangerine" || !user.UpdatedAt.Equal(start.Add(time.Hour)) || user.Budget != 8 {
+		t.Fatal(fmt.Sprintf("Actual: %+v - %v\tExpected: Tangerine, tangerine, a new updatedAt, and the same budget - %v", user, err, nil))
+	}
+	if _, err := d.GetUser(ctx, "orange"); err != store.ErrNotFound {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	expected := map[string]int{"to tangerine": 2, "from tangerine": 2, "to orange": 0, "from orange": 0, "unread tangerine": 2}
+	actual := map[string]int{}
+	for _, username := range []string{"tangerine", "orange"} {
+		for name, q := range map[string]store.MessageQuery{"to ": {To: username}, "from ": {From: username}} {
+			messages, err := d.FindMessages(ctx, q)
+			if err != nil {
+				t.Fatal(fmt.Sprintln("Unknown error:", err))
+			}
+			actual[name+username] = len(messages.Entries)
+		}
+	}
+	if actual["unread tangerine"], err = d.CountUnread(ctx, "tangerine"); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", actual, expected))
+	}
+	if tombstone, err := d.GetMessage(ctx, sent[3].ID); err != nil || tombstone.To != "tangerine" {
+		t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", tombstone.To, err, "tangerine", nil))
+	}
+	// The old username is free again.
+	if unique, err := d.IsUnique(ctx, types.User{Username: "orange"}); err != nil || !unique {
+		t.Error(fmt.Sprintf("Actual: %t - %v\tExpected: %t - %v", unique, err, true, nil))
+	}
+	user, err = d.DeactivateUser(ctx, users["banana"].ID, start.Add(2*time.Hour))
+	if err != nil || user.DeactivatedAt == nil || !user.DeactivatedAt.Equal(start.Add(2*time.Hour)) {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", user.DeactivatedAt, err, start.Add(2*time.Hour), nil))
+	}
+	if _, err := d.DeactivateUser(ctx, users["banana"].ID, start.Add(3*time.Hour)); err != store.ErrConflict {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	if _, err := d.UpdateUser(ctx, users["banana"].ID, "Plantain", "plantain", start.Add(3*time.Hour)); err != store.ErrConflict {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+}
+
+// TestSetBudget tests that budgets only change while they're still what the caller last saw, and that reset times survive the trip to the database.
+func TestSetBudget(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	user := types.User{Name: "Orange", Username: "orange", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &user); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	resets := time.Date(2018, 2, 22, 0, 0, 0, 0, time.UTC)
+	updated, err := d.SetBudget(ctx, user, 10, &resets)
+	if err != nil || updated.Budget != 10 || updated.BudgetResetsAt == nil || !updated.BudgetResetsAt.Equal(resets) {
+		t.Fatal(fmt.Sprintf("Actual: %d - %v - %v\tExpected: %d - %v - %v", updated.Budget, updated.BudgetResetsAt, err, 10, resets, nil))
+	}
+	// The old user is out of date now.
+	if _, err := d.SetBudget(ctx, user, 5, nil); !errors.Is(err, store.ErrConflict) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	stored, err := d.GetUserByID(ctx, user.ID)
+	if err != nil || stored.Budget != 10 || stored.BudgetResetsAt == nil || !stored.BudgetResetsAt.Equal(resets) {
+		t.Fatal(fmt.Sprintf("Actual: %d - %v - %v\tExpected: %d - %v - %v", stored.Budget, stored.BudgetResetsAt, err, 10, resets, nil))
+	}
+	// The stored one isn't, and no reset time is fine too.
+	if updated, err := d.SetBudget(ctx, stored, 5, nil); err != nil || updated.Budget != 5 || updated.BudgetResetsAt != nil {
+		t.Error(fmt.Sprintf("Actual: %d - %v - %v\tExpected: %d - %v - %v", updated.Budget, updated.BudgetResetsAt, err, 5, nil, nil))
+	}
+	if _, err := d.SetBudget(ctx, types.User{ID: types.NewID()}, 5, nil); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestLedger tests that opening, sending, and refilling each leave an entry in the ledger, so that it adds up to the budget.
+func TestLedger(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	users := map[string]types.User{}
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 2, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		users[username] = user
+	}
+	message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now(), Cost: 1}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	orange, err := d.GetUserByID(ctx, users["orange"].ID)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.SetBudget(ctx, orange, 5, nil); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	entries, err := d.Ledger(ctx, users["orange"].ID)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	expected := "[open 2 2 ] [send -1 1 " + string(message.ID) + "] [refill 4 5 ]"
+	actual := ""
+	for _, e := range entries {
+		actual += fmt.Sprintf(" [%s %d %d %s]", e.Reason, e.Amount, e.Balance, e.MessageID)
+	}
+	if strings.TrimSpace(actual) != expected {
+		t.Error(fmt.Sprintf("Actual: %s\tExpected: %s", actual, expected))
+	}
+	if found, err := store.Reconcile(ctx, d); err != nil || len(found) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", found, err, "[]", nil))
+	}
+	if _, err := d.Ledger(ctx, types.NewID()); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestGrantBudget tests that grants add to the budget and go in the ledger with their note, and that budgets can't be taken below zero, nor deactivated users given any.
+func TestGrantBudget(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	user := types.User{Name: "Orange", Username: "orange", Budget: 2, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &user); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if updated, err := d.GrantBudget(ctx, user.ID, 5, "Apology.", time.Now()); err != nil || updated.Budget != 7 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", updated.Budget, err, 7, nil))
+	}
+	if updated, err := d.GrantBudget(ctx, user.ID, -7, "Spam.", time.Now()); err != nil || updated.Budget != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", updated.Budget, err, 0, nil))
+	}
+	if _, err := d.GrantBudget(ctx, user.ID, -1, "More spam.", time.Now()); !errors.Is(err, store.ErrBudgetExhausted) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrBudgetExhausted))
+	}
+	entries, err := d.Ledger(ctx, user.ID)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	expected := "[open 2 2 ] [grant 5 7 Apology.] [grant -7 0 Spam.]"
+	actual := ""
+	for _, e := range entries {
+		actual += fmt.Sprintf(" [%s %d %d %s]", e.Reason, e.Amount, e.Balance, e.Note)
+	}
+	if strings.TrimSpace(actual) != expected {
+		t.Error(fmt.Sprintf("Actual: %s\tExpected: %s", actual, expected))
+	}
+	if found, err := store.Reconcile(ctx, d); err != nil || len(found) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", found, err, "[]", nil))
+	}
+	if _, err := d.DeactivateUser(ctx, user.ID, time.Now()); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.GrantBudget(ctx, user.ID, 1, "Hi.", time.Now()); !errors.Is(err, store.ErrConflict) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	if _, err := d.GrantBudget(ctx, types.NewID(), 1, "Hi.", time.Now()); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestOpenLedgers tests that the ledger migration opens ledgers for users that don't have one, with their budget as it is, and leaves the others alone.
+func TestOpenLedgers(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 3, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now()}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	// Banana's ledger goes missing, the way it would have for anyone from before there was one.
+	banana, _ := d.GetUser(ctx, "banana")
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		prefix := append([]byte(banana.ID), 0)
+		c := tx.Bucket(ledgerBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if found, err := store.Reconcile(ctx, d); err != nil || len(found) != 1 || found[0].User.Username != "banana" || found[0].Ledger != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: banana with nothing in the ledger - %v", found, err, nil))
+	}
+	if err := d.openLedgers(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if found, err := store.Reconcile(ctx, d); err != nil || len(found) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", found, err, "[]", nil))
+	}
+	for username, expected := range map[string]int{"orange": 2, "banana": 1} {
+		user, _ := d.GetUser(ctx, username)
+		if entries, err := d.Ledger(ctx, user.ID); err != nil || len(entries) != expected {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %v\tExpected: %d - %v", username, len(entries), err, expected, nil))
+		}
+	}
+}
+
+// TestPriceMessages tests that the pricing migration gives messages without a cost a cost of 1, and leaves priced ones alone.
+func TestPriceMessages(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	// The first one is from before messages had a price.
+	sent := []types.Message{
+		{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now()},
+		{From: "banana", To: "orange", Body: "Hi!", SentAt: time.Now(), Cost: 3},
+	}
+	for i := range sent {
+		if err := d.SendMessage(ctx, &sent[i]); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	if err := d.priceMessages(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	for i, expected := range []int{1, 3} {
+		if message, err := d.GetMessage(ctx, sent[i].ID); err != nil || message.Cost != expected {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %v\tExpected: %d - %v", sent[i].Body, message.Cost, err, expected, nil))
+		}
+	}
+}
+
+// TestUsers tests that usernames are unique, and that users can't be found where they don't exist.
+func TestUsers(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	user := types.User{Name: "Orange", Username: "orange", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if unique, err := d.IsUnique(ctx, user); err != nil || !unique {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", unique, err, true, nil))
+	}
+	if err := d.AddUser(ctx, &user); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if unique, err := d.IsUnique(ctx, user); err != nil || unique {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", unique, err, false, nil))
+	}
+	twin := types.User{Name: "Other Orange", Username: "orange", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &twin); !errors.Is(err, store.ErrDuplicate) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrDuplicate))
+	}
+	if found, err := d.GetUser(ctx, "orange"); err != nil || found.ID != user.ID {
+		t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", found.ID, err, user.ID, nil))
+	}
+	if found, err := d.GetUserByID(ctx, user.ID); err != nil || found.Username != "orange" {
+		t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", found.Username, err, "orange", nil))
+	}
+	if _, err := d.GetUser(ctx, "banana"); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	if _, err := d.GetUserByID(ctx, types.NewID()); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestSendMessageBudget tests that messages the sender can't afford, or that come from nobody, are refused without storing or charging anything.
+func TestSendMessageBudget(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 2, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	expensive := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now(), Cost: 3}
+	if err := d.SendMessage(ctx, &expensive); !errors.Is(err, store.ErrBudgetExhausted) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrBudgetExhausted))
+	}
+	stranger := types.Message{From: "apple", To: "banana", Body: "Hi.", SentAt: time.Now(), Cost: 1}
+	if err := d.SendMessage(ctx, &stranger); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	if all, err := d.ListMessages(ctx); err != nil || len(all) != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", len(all), err, 0, nil))
+	}
+	if unread, err := d.CountUnread(ctx, "banana"); err != nil || unread != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", unread, err, 0, nil))
+	}
+	orange, err := d.GetUser(ctx, "orange")
+	if err != nil || orange.Budget != 2 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", orange.Budget, err, 2, nil))
+	}
+	if entries, err := d.Ledger(ctx, orange.ID); err != nil || len(entries) != 1 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", len(entries), err, 1, nil))
+	}
+	// Exactly what's left is still affordable.
+	exact := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now(), Cost: 2}
+	if err := d.SendMessage(ctx, &exact); err != nil {
+		t.Error(fmt.Sprintln("Unknown error:", err))
+	}
+	if orange, err := d.GetUser(ctx, "orange"); err != nil || orange.Budget != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", orange.Budget, err, 0, nil))
+	}
+}
+
+// TestObjectIDsToIDs tests that the first migration moves users and messages kept under MongoDB ObjectIds to IDs for the same time, and points usernames at the new ones.
+func TestObjectIDsToIDs(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	// ObjectIds start with a timestamp in seconds. The rest of it doesn't matter here.
+	created := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	objectID := func(at time.Time, n byte) []byte {
+		id := make([]byte, 12)
+		binary.BigEndian.PutUint32(id, uint32(at.Unix()))
+		id[11] = n
+		return id
+	}
+	userKey, messageKey := objectID(created, 1), objectID(created.Add(time.Hour), 2)
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		user := types.User{Name: "Orange", Username: "orange", Budget: 7, CreatedAt: created, UpdatedAt: created}
+		if err := put(tx.Bucket(usersBucket), string(userKey), user); err != nil {
+			return err
+		}
+		if err := tx.Bucket(usernamesBucket).Put([]byte("orange"), userKey); err != nil {
+			return err
+		}
+		message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: created.Add(time.Hour)}
+		return put(tx.Bucket(messagesBucket), string(messageKey), message)
+	})
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if err := d.objectIDsToIDs(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	user, err := d.GetUser(ctx, "orange")
+	if err != nil || !types.IsID(string(user.ID)) || !user.ID.Time().Equal(created) || user.Budget != 7 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: orange, with an ID from %v - %v", user, err, created, nil))
+	}
+	if found, err := d.GetUserByID(ctx, user.ID); err != nil || found.Username != "orange" {
+		t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", found.Username, err, "orange", nil))
+	}
+	messages, err := d.ListMessages(ctx)
+	if err != nil || len(messages) != 1 || !types.IsID(string(messages[0].ID)) || !messages[0].ID.Time().Equal(created.Add(time.Hour)) || messages[0].Body != "Hi." {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: one message, with an ID from %v - %v", messages, err, created.Add(time.Hour), nil))
+	}
+	// Nothing's left under the old keys.
+	d.DB.View(func(tx *bolt.Tx) error {
+		for _, b := range []*bolt.Bucket{tx.Bucket(usersBucket), tx.Bucket(messagesBucket)} {
+			b.ForEach(func(k, v []byte) error {
+				if len(k) == 12 {
+					t.Error(fmt.Sprintf("Actual: %x\tExpected: no ObjectId keys", k))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// TestSendMessageConcurrentBudget tests that a burst of concurrent sends from the same user never takes their budget below zero, and that the ledger keeps up with every one that goes through.
+func TestSendMessageConcurrentBudget(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 7, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	// Way more messages than the sender can afford, all at once.
+	attempts := 7 * 5
+	results := make(chan error, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			message := types.Message{From: "orange", To: "banana", Body: fmt.Sprint("Message ", i), SentAt: time.Now(), Cost: 1}
+			results <- d.SendMessage(ctx, &message)
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	sent, refused := 0, 0
+	for err := range results {
+		switch {
+		case err == nil:
+			sent++
+		case errors.Is(err, store.ErrBudgetExhausted):
+			refused++
+		default:
+			t.Error(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	if sent != 7 || refused != attempts-7 {
+		t.Error(fmt.Sprintf("Actual: %d sent, %d refused\tExpected: %d sent, %d refused", sent, refused, 7, attempts-7))
+	}
+	if orange, err := d.GetUser(ctx, "orange"); err != nil || orange.Budget != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", orange.Budget, err, 0, nil))
+	}
+	if all, err := d.ListMessages(ctx); err != nil || len(all) != 7 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", len(all), err, 7, nil))
+	}
+	if found, err := store.Reconcile(ctx, d); err != nil || len(found) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", found, err, "[]", nil))
+	}
+}
@@ -0,0 +1,259 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/ellenkorbes/chatty/migrate"
+	"github.com/ellenkorbes/chatty/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Migrations returns every migration this backend knows about. New ones go at the end, with the next version number.
+func (db DBObject) Migrations() []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "Replace MongoDB ObjectId keys with UUIDv7 IDs",
+			Up:          db.objectIDsToIDs,
+		},
+		{
+			Version:     2,
+			Description: "Index messages by recipient and by sender",
+			Up:          db.indexMessages,
+			Down:        db.dropMessageIndexes,
+		},
+		{
+			Version:     3,
+			Description: "Index unread messages",
+			Up:          db.indexUnread,
+			Down:        db.dropUnreadIndex,
+		},
+		{
+			Version:     4,
+			Description: "Open budget ledgers for users from before there was one",
+			Up:          db.openLedgers,
+		},
+		{
+			Version:     5,
+			Description: "Price messages from before messages had a price at 1, which is what they cost",
+			Up:          db.priceMessages,
+		},
+	}
+}
+
+// Applied returns the versions applied so far, and when. They're kept in the migrations bucket, keyed by version.
+func (db DBObject) Applied(ctx context.Context) (map[int]time.Time, error) {
+	applied := map[int]time.Time{}
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(migrationsBucket).ForEach(func(k, v []byte) error {
+			at, err := time.Parse(time.RFC3339Nano, string(v))
+			if err != nil {
+				return err
+			}
+			applied[int(binary.BigEndian.Uint64(k))] = at
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// SetApplied records a version as applied, or as not applied anymore.
+func (db DBObject) SetApplied(ctx context.Context, version int, applied bool) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return setApplied(tx, version, applied)
+	})
+}
+
+// setApplied does the work for SetApplied within a transaction, so NewSession can record migrations in the same one that creates the buckets.
+func setApplied(tx *bolt.Tx, version int, applied bool) error {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	if !applied {
+		return tx.Bucket(migrationsBucket).Delete(key)
+	}
+	return tx.Bucket(migrationsBucket).Put(key, []byte(time.Now().Format(time.RFC3339Nano)))
+}
+
+// objectIDsToIDs rekeys users and messages stored before IDs became UUIDv7s. Back then keys were the 12 raw bytes of a MongoDB ObjectId, whose first 4 bytes are a timestamp in seconds, so each record gets a new ID for that time. There's no way back: nothing else needs the old IDs, and nothing could use them anymore.
+func (db DBObject) objectIDsToIDs(ctx context.Context) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		users, usernames, messages := tx.Bucket(usersBucket), tx.Bucket(usernamesBucket), tx.Bucket(messagesBucket)
+		err := rekey(users, func(old []byte, v []byte) ([]byte, []byte, error) {
+			user := types.User{}
+			if err := json.Unmarshal(v, &user); err != nil {
+				return nil, nil, err
+			}
+			user.ID = types.NewIDAt(objectIDTime(old))
+			if err := usernames.Put([]byte(user.Username), []byte(user.ID)); err != nil {
+				return nil, nil, err
+			}
+			data, err := json.Marshal(user)
+			return []byte(user.ID), data, err
+		})
+		if err != nil {
+			return err
+		}
+		return rekey(messages, func(old []byte, v []byte) ([]byte, []byte, error) {
+			message := types.Message{}
+			if err := json.Unmarshal(v, &message); err != nil {
+				return nil, nil, err
+			}
+			message.ID = types.NewIDAt(objectIDTime(old))
+			data, err := json.Marshal(message)
+			return []byte(message.ID), data, err
+		})
+	})
+}
+
+// rekey runs convert on every record in b whose key is an ObjectId, and moves it to the key and value convert returns.
+func rekey(b *bolt.Bucket, convert func(k, v []byte) ([]byte, []byte, error)) error {
+	// Buckets can't be changed while we're walking through them, so first we find what needs changing.
+	old := [][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		if len(k) == 12 {
+			old = append(old, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range old {
+		key, value, err := convert(k, b.Get(k))
+		if err != nil {
+			return err
+		}
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+		if err := b.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectIDTime returns the time a MongoDB ObjectId was created at.
+func objectIDTime(id []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint32(id[0:4])), 0)
+}
+
+// indexMessages fills the inbox and outbox indexes with every message stored before they existed. Entries already there are simply written again.
+func (db DBObject) indexMessages(ctx context.Context) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+			message := types.Message{}
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			return index(tx, message)
+		})
+	})
+}
+
+// dropMessageIndexes empties the inbox and outbox indexes.
+func (db DBObject) dropMessageIndexes(ctx context.Context) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{inboxBucket, outboxBucket} {
+			if err := tx.DeleteBucket(b); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// indexUnread fills the unread index with every unread message stored before it existed.
+func (db DBObject) indexUnread(ctx context.Context) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		unread := tx.Bucket(unreadBucket)
+		return tx.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+			message := types.Message{}
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			if message.ReadAt != nil || message.DeletedAt != nil {
+				return nil
+			}
+			return unread.Put(indexKey(message.To, message.SentAt, message.ID), []byte{})
+		})
+	})
+}
+
+// dropUnreadIndex empties the unread index.
+func (db DBObject) dropUnreadIndex(ctx context.Context) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(unreadBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(unreadBucket)
+		return err
+	})
+}
+
+// openLedgers gives every user without a ledger an opening entry with their budget as it is, dated when they signed up, so their ledger adds up. There's no way back: by the time anyone would want one, those ledgers have moved on.
+func (db DBObject) openLedgers(ctx context.Context) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		ledger := tx.Bucket(ledgerBucket).Cursor()
+		opened := []types.User{}
+		err := tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			prefix := append(append([]byte{}, k...), 0)
+			if k, _ := ledger.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+				return nil
+			}
+			user := types.User{}
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			opened = append(opened, user)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, user := range opened {
+			if err := record(tx, user, types.LedgerEntry{Amount: user.Budget, Reason: types.ReasonOpen, CreatedAt: user.CreatedAt}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// priceMessages gives every message without a cost the 1 it cost back then. There's no way back: once rates change, there's no telling which ones were priced here.
+func (db DBObject) priceMessages(ctx context.Context) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		messages := tx.Bucket(messagesBucket)
+		priced := []types.Message{}
+		err := messages.ForEach(func(k, v []byte) error {
+			message := types.Message{}
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			if message.Cost == 0 {
+				message.Cost = 1
+				priced = append(priced, message)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, message := range priced {
+			if err := put(messages, string(message.ID), message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,172 @@
+// Package budget decides how users' budgets fill back up over time. Each deployment picks one Policy. Policies only ever look at a user and the time, so they can be applied lazily whenever a user is looked at, or all at once by a scheduler, with the same results.
+package budget
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// Policy is a way for budgets to fill back up.
+type Policy interface {
+	Apply(types.User, time.Time) types.User // Returns the user with every refill that was due by then, and with BudgetResetsAt set to when the next one is. Only Budget and BudgetResetsAt ever change.
+	String() string                         // Returns the policy in the form Parse takes.
+}
+
+// ErrBadPolicy is returned by Parse when it can't make sense of a policy.
+var ErrBadPolicy = errors.New(`invalid budget policy, pick one of: none, daily:N, monthly:N, or bucket:N/interval, as in bucket:10/1h`)
+
+// ErrBadPlans is returned by ParsePlans when it can't make sense of a list of plans.
+var ErrBadPlans = errors.New(`invalid plans, they go as name:budget separated by commas, as in free:10,pro:100`)
+
+// planFormat is what plan names look like, which is the same as usernames.
+var planFormat = regexp.MustCompile(`^[a-z][a-z_\.\-0-9]*$`)
+
+// None never refills anything. Once a budget is spent, it's spent.
+type None struct{}
+
+// Apply returns the user as it is.
+func (None) Apply(u types.User, now time.Time) types.User {
+	return u
+}
+
+func (None) String() string {
+	return "none"
+}
+
+// Daily tops budgets back up to Limit at midnight UTC every day. Budgets above Limit are left alone.
+type Daily struct {
+	Limit int
+}
+
+// Apply tops the budget up if midnight has gone by since the last time, and sets the next reset to the coming midnight. Users that have never had a reset get one right away.
+func (p Daily) Apply(u types.User, now time.Time) types.User {
+	return reset(u, now, p.Limit, func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	})
+}
+
+func (p Daily) String() string {
+	return fmt.Sprint("daily:", p.Limit)
+}
+
+// Monthly tops budgets back up to Limit at midnight UTC on the first of every month. Budgets above Limit are left alone.
+type Monthly struct {
+	Limit int
+}
+
+// Apply tops the budget up if a month has started since the last time, and sets the next reset to the first of the coming month. Users that have never had a reset get one right away.
+func (p Monthly) Apply(u types.User, now time.Time) types.User {
+	return reset(u, now, p.Limit, func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	})
+}
+
+func (p Monthly) String() string {
+	return fmt.Sprint("monthly:", p.Limit)
+}
+
+// reset does the work for Daily and Monthly, which only differ in when the next reset is.
+func reset(u types.User, now time.Time, limit int, next func(time.Time) time.Time) types.User {
+	if u.BudgetResetsAt != nil && now.Before(*u.BudgetResetsAt) {
+		return u
+	}
+	if u.Budget < limit {
+		u.Budget = limit
+	}
+	resets := next(now.UTC())
+	u.BudgetResetsAt = &resets
+	return u
+}
+
+// TokenBucket gives budgets back one unit at a time, one every Every, until they're back up to Capacity. The clock starts once the budget drops below Capacity, and stops once it's back up, so there's no next reset for full budgets.
+type TokenBucket struct {
+	Capacity int
+	Every    time.Duration
+}
+
+// Apply adds a unit for every Every that's gone by since the clock started, up to Capacity.
+func (p TokenBucket) Apply(u types.User, now time.Time) types.User {
+	if u.BudgetResetsAt != nil && !now.Before(*u.BudgetResetsAt) {
+		due := 1 + int(now.Sub(*u.BudgetResetsAt)/p.Every)
+		if u.Budget < p.Capacity {
+			u.Budget += due
+			if u.Budget > p.Capacity {
+				u.Budget = p.Capacity
+			}
+		}
+		resets := u.BudgetResetsAt.Add(time.Duration(due) * p.Every)
+		u.BudgetResetsAt = &resets
+	}
+	switch {
+	case u.Budget >= p.Capacity:
+		u.BudgetResetsAt = nil
+	case u.BudgetResetsAt == nil:
+		// Stored times only go down to the millisecond, so this one does too, or it wouldn't match itself once stored.
+		resets := now.Add(p.Every).Truncate(time.Millisecond)
+		u.BudgetResetsAt = &resets
+	}
+	return u
+}
+
+func (p TokenBucket) String() string {
+	return fmt.Sprintf("bucket:%d/%s", p.Capacity, p.Every)
+}
+
+// Parse turns a policy in the form none, daily:N, monthly:N, or bucket:N/interval into a Policy. Intervals are anything time.ParseDuration takes, as in bucket:10/1h.
+func Parse(s string) (Policy, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "none":
+		if arg != "" {
+			return nil, ErrBadPolicy
+		}
+		return None{}, nil
+	case "daily", "monthly":
+		limit, err := strconv.Atoi(arg)
+		if err != nil || limit < 1 {
+			return nil, ErrBadPolicy
+		}
+		if kind == "daily" {
+			return Daily{Limit: limit}, nil
+		}
+		return Monthly{Limit: limit}, nil
+	case "bucket":
+		capacity, every, _ := strings.Cut(arg, "/")
+		c, err := strconv.Atoi(capacity)
+		if err != nil || c < 1 {
+			return nil, ErrBadPolicy
+		}
+		e, err := time.ParseDuration(every)
+		if err != nil || e <= 0 {
+			return nil, ErrBadPolicy
+		}
+		return TokenBucket{Capacity: c, Every: e}, nil
+	}
+	return nil, ErrBadPolicy
+}
+
+// ParsePlans turns a list of plans in the form name:budget,name:budget into the budget new users on each plan start with, by name. A blank list means there are no plans.
+func ParsePlans(s string) (map[string]int, error) {
+	plans := map[string]int{}
+	if s == "" {
+		return plans, nil
+	}
+	for _, plan := range strings.Split(s, ",") {
+		name, start, _ := strings.Cut(plan, ":")
+		budget, err := strconv.Atoi(start)
+		if err != nil || budget < 0 || !planFormat.MatchString(name) {
+			return nil, ErrBadPlans
+		}
+		if _, ok := plans[name]; ok {
+			return nil, ErrBadPlans
+		}
+		plans[name] = budget
+	}
+	return plans, nil
+}
@@ -0,0 +1,91 @@
+package budget
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// at returns a pointer to a time, for BudgetResetsAt.
+func at(t time.Time) *time.Time {
+	return &t
+}
+
+// TestApply tests each policy against users in all sorts of states, from never reset to long overdue.
+func TestApply(t *testing.T) {
+	now := time.Date(2018, 2, 21, 13, 32, 53, 0, time.UTC)
+	midnight := time.Date(2018, 2, 22, 0, 0, 0, 0, time.UTC)
+	march := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		policy   Policy
+		budget   int
+		resetsAt *time.Time
+		expected int
+		next     *time.Time
+	}{
+		{None{}, 3, nil, 3, nil},
+		{None{}, 0, at(now.Add(-time.Hour)), 0, at(now.Add(-time.Hour))},
+		// Never reset, so reset right away.
+		{Daily{Limit: 10}, 3, nil, 10, &midnight},
+		// Not due yet.
+		{Daily{Limit: 10}, 3, &midnight, 3, &midnight},
+		// Overdue, by however long.
+		{Daily{Limit: 10}, 0, at(now.Add(-time.Minute)), 10, &midnight},
+		{Daily{Limit: 10}, 0, at(now.AddDate(0, 0, -30)), 10, &midnight},
+		// More than the limit stays.
+		{Daily{Limit: 10}, 12, at(now.Add(-time.Minute)), 12, &midnight},
+		{Monthly{Limit: 100}, 0, nil, 100, &march},
+		{Monthly{Limit: 100}, 5, &march, 5, &march},
+		{Monthly{Limit: 100}, 5, at(now.Add(-time.Second)), 100, &march},
+		// Full buckets have no clock running.
+		{TokenBucket{Capacity: 5, Every: time.Hour}, 5, nil, 5, nil},
+		{TokenBucket{Capacity: 5, Every: time.Hour}, 7, at(now.Add(-time.Hour)), 7, nil},
+		// Below capacity starts the clock.
+		{TokenBucket{Capacity: 5, Every: time.Hour}, 2, nil, 2, at(now.Add(time.Hour))},
+		{TokenBucket{Capacity: 5, Every: time.Hour}, 2, at(now.Add(time.Minute)), 2, at(now.Add(time.Minute))},
+		// One unit due, then two, with the clock keeping its own schedule rather than starting over.
+		{TokenBucket{Capacity: 5, Every: time.Hour}, 2, at(now), 3, at(now.Add(time.Hour))},
+		{TokenBucket{Capacity: 5, Every: time.Hour}, 0, at(now.Add(-90 * time.Minute)), 2, at(now.Add(30 * time.Minute))},
+		// Back up to capacity and no further.
+		{TokenBucket{Capacity: 5, Every: time.Hour}, 4, at(now.Add(-90 * time.Minute)), 5, nil},
+	}
+	for _, test := range tests {
+		user := test.policy.Apply(types.User{Budget: test.budget, BudgetResetsAt: test.resetsAt}, now)
+		if user.Budget != test.expected || fmt.Sprint(user.BudgetResetsAt) != fmt.Sprint(test.next) {
+			t.Error(fmt.Sprintf("%s %d %v\tActual: %d - %v\tExpected: %d - %v", test.policy, test.budget, test.resetsAt, user.Budget, user.BudgetResetsAt, test.expected, test.next))
+		}
+	}
+}
+
+// TestParse tests that policies come back out of Parse the same as they went in, and that nonsense doesn't.
+func TestParse(t *testing.T) {
+	for _, s := range []string{"none", "daily:10", "monthly:300", "bucket:10/1h0m0s", "bucket:3/30s"} {
+		policy, err := Parse(s)
+		if err != nil || policy.String() != s {
+			t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %s - %v", policy, err, s, nil))
+		}
+	}
+	for _, s := range []string{"", "none:1", "daily", "daily:0", "daily:ten", "weekly:10", "bucket:10", "bucket:10/", "bucket:0/1h", "bucket:10/-1h"} {
+		if _, err := Parse(s); err != ErrBadPolicy {
+			t.Error(fmt.Sprintf("%q\tActual: %v\tExpected: %v", s, err, ErrBadPolicy))
+		}
+	}
+}
+
+// TestParsePlans tests that plans come out with their budgets, and that nonsense and duplicates don't.
+func TestParsePlans(t *testing.T) {
+	plans, err := ParsePlans("free:10,pro:100,staff:0")
+	if err != nil || fmt.Sprint(plans) != "map[free:10 pro:100 staff:0]" {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %s - %v", plans, err, "map[free:10 pro:100 staff:0]", nil))
+	}
+	if plans, err := ParsePlans(""); err != nil || len(plans) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %s - %v", plans, err, "map[]", nil))
+	}
+	for _, s := range []string{"free", "free:", "free:-1", "Free:10", ":10", "free:10,", "free:10,free:20"} {
+		if _, err := ParsePlans(s); err != ErrBadPlans {
+			t.Error(fmt.Sprintf("%q\tActual: %v\tExpected: %v", s, err, ErrBadPlans))
+		}
+	}
+}
@@ -1,60 +1,180 @@
 package ctrl
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ellenkorbes/chatty/budget"
+	"github.com/ellenkorbes/chatty/pricing"
+	"github.com/ellenkorbes/chatty/store"
 	"github.com/ellenkorbes/chatty/types"
-	"gopkg.in/mgo.v2/bson"
 )
 
 // DBInterface allows us to inject as our DB package anything that fulfills this interface.
 type DBInterface interface {
-	Add(interface{}) error
-	Get(bson.ObjectId, interface{}) error
-	GetAll(interface{}) error
-	GetUser(string) (types.User, error)
-	DecreaseBudget(types.User) error
-	GetMessagesByUser(string) (types.Messages, error)
-	IsUnique(types.User) (bool, error)
+	store.UserStore
+	store.MessageStore
 }
 
+// DefaultTimeout is how long each database call gets, unless told otherwise.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultStartBudget is how much budget new users start with, unless told otherwise or they're on a plan.
+const DefaultStartBudget = 10
+
+// DefaultEditWindow is how long after sending a message its sender can still edit it, unless told otherwise.
+const DefaultEditWindow = 15 * time.Minute
+
+// Page sizes for message listings. Clients pick one with the limit parameter.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+)
+
+// UserHeader is the request header that says which user is making the request. We take its word for it, so whatever sits in front of us had better check it.
+const UserHeader = "X-Chatty-User"
+
 // Controller is... pretty simple, just look at it.
 type Controller struct {
-	DB DBInterface
+	DB          DBInterface
+	Timeout     time.Duration  // How long each database call gets. Every call gets its own, so a request that makes several can take longer than this altogether. Zero means no limit other than the client's patience.
+	EditWindow  time.Duration  // How long after sending a message its sender can still edit it. Zero means forever.
+	Budget      budget.Policy  // How users' budgets fill back up.
+	Pricing     pricing.Rates  // What messages cost to send.
+	StartBudget int            // How much budget new users start with, unless they're on a plan.
+	Plans       map[string]int // The tiers new users can sign up on, by name, each with the budget its users start with. Only admins get to pick one.
+	AdminToken  string         // What admin requests need in their Authorization header, as in Bearer {token}. Blank turns admin requests off altogether.
 }
 
 // NewController returns a new Controller.
 func NewController(db DBInterface) *Controller {
 	return &Controller{
-		DB: db,
+		DB:          db,
+		Timeout:     DefaultTimeout,
+		EditWindow:  DefaultEditWindow,
+		Budget:      budget.None{},
+		Pricing:     pricing.Default,
+		StartBudget: DefaultStartBudget,
+		Plans:       map[string]int{},
+	}
+}
+
+// admin checks that a request carries the admin token. If it doesn't, it returns the status and ErrorMessage key to answer with, and sets the WWW-Authenticate header when the token is missing. Otherwise the status is zero.
+func (c *Controller) admin(response http.ResponseWriter, request *http.Request) (int, string) {
+	if c.AdminToken == "" {
+		return http.StatusForbidden, "AdminDisabled"
+	}
+	scheme, token, _ := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		response.Header().Set("WWW-Authenticate", `Bearer realm="chatty"`)
+		return http.StatusUnauthorized, "MissingToken"
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) != 1 {
+		return http.StatusForbidden, "BadToken"
 	}
+	return 0, ""
+}
+
+// usernameFormat is what usernames look like: only lowercase alphanumericals, underscores, dots, and hyphens, starting with a letter.
+var usernameFormat = regexp.MustCompile(`^[a-z][a-z_\.\-0-9]*$`)
+
+// ByUsername is the bit of /users/by-username/{username} that says a username follows. It can't be used as a username itself.
+const ByUsername = "by-username"
+
+// isReserved tells whether a username can't be taken even though it looks fine. Usernames that parse as IDs are reserved, so /users/{idOrUsername} is never ambiguous.
+func isReserved(username string) bool {
+	return types.IsID(username) || username == ByUsername
+}
+
+// isUserRef tells whether a bit of a URL could be a user ID or a username.
+func isUserRef(ref string) bool {
+	return types.IsID(ref) || usernameFormat.MatchString(ref)
+}
+
+// findUser gets a user by ID or by username, whichever ref is.
+func (c *Controller) findUser(ctx context.Context, ref string) (types.User, error) {
+	if id, err := types.ParseID(ref); err == nil {
+		return c.db().GetUserByID(ctx, id)
+	}
+	return c.db().GetUser(ctx, ref)
+}
+
+// refill applies the budget policy to a user and stores the result, if it changed anything. If the budget changed in the meantime, say because the user sent a message, it starts over with the fresh one. Deactivated users are left as they are.
+func (c *Controller) refill(ctx context.Context, user types.User) (types.User, error) {
+	for user.DeactivatedAt == nil {
+		refilled := c.Budget.Apply(user, time.Now())
+		if refilled.Budget == user.Budget && store.SameTime(refilled.BudgetResetsAt, user.BudgetResetsAt) {
+			break
+		}
+		updated, err := c.db().SetBudget(ctx, user, refilled.Budget, refilled.BudgetResetsAt)
+		if !errors.Is(err, store.ErrConflict) {
+			return updated, err
+		}
+		if user, err = c.db().GetUserByID(ctx, user.ID); err != nil {
+			return types.User{}, err
+		}
+	}
+	return user, nil
+}
+
+// RefillBudgets applies the budget policy to every user and stores the results, so budgets are up to date even for users nobody has looked at. It returns how many users it changed. Meant to run every so often in the background, with a context of its own.
+func (c *Controller) RefillBudgets(ctx context.Context) (int, error) {
+	users, err := c.db().ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, user := range users {
+		refilled, err := c.refill(ctx, user)
+		if err != nil {
+			return changed, err
+		}
+		if refilled.Budget != user.Budget || !store.SameTime(refilled.BudgetResetsAt, user.BudgetResetsAt) {
+			changed++
+		}
+	}
+	return changed, nil
 }
 
 // ListAllUsers lists all registered users.
 func (c *Controller) ListAllUsers(response http.ResponseWriter, request *http.Request) {
-	c.ListAll(response, request, &[]types.User{})
+	ctx := request.Context()
+	users, err := c.db().ListUsers(ctx)
+	if err != nil {
+		DBError(response, request, err, "", "c.ListAllUsers: "+ErrorMessage["db.ListUsers"])
+		return
+	}
+	// Budgets as they'd be if we refilled them now, without the trouble of actually doing it.
+	for i := range users {
+		if users[i].DeactivatedAt == nil {
+			users[i] = c.Budget.Apply(users[i], time.Now())
+		}
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&users)
 }
 
 // ListAllMessages lists all messages.
 func (c *Controller) ListAllMessages(response http.ResponseWriter, request *http.Request) {
-	c.ListAll(response, request, &[]types.Message{})
-}
-
-// ListAll lists all items of type *[]types.User or *[]types.Message.
-func (c *Controller) ListAll(response http.ResponseWriter, request *http.Request, items interface{}) {
-	err := c.DB.GetAll(items)
+	ctx := request.Context()
+	messages, err := c.db().ListMessages(ctx)
 	if err != nil {
-		Error(response, request, http.StatusInternalServerError, "c.ListAll: "+ErrorMessage["db.GetAll"])
+		DBError(response, request, err, "", "c.ListAllMessages: "+ErrorMessage["db.ListMessages"])
 		return
 	}
 	response.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(response).Encode(items)
+	json.NewEncoder(response).Encode(&messages)
 }
 
 // NewUser creates a new user and returns the resulting object.
@@ -70,34 +190,53 @@ func (c *Controller) NewUser(response http.ResponseWriter, request *http.Request
 		Error(response, request, http.StatusBadRequest, ErrorMessage["BadJSON"])
 		return
 	}
-	// Only lowercase alphanumericals, dots, and hyphens.
-	r, _ := regexp.Compile(`^[a-z][a-z_\.\-0-9]*$`)
-	if !r.MatchString(newUser.Username) {
+	if !usernameFormat.MatchString(newUser.Username) {
 		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUsername"])
 		return
 	}
+	if isReserved(newUser.Username) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["ReservedUsername"])
+		return
+	}
 	if newUser.Name == "" {
 		Error(response, request, http.StatusBadRequest, ErrorMessage["BlankUsername"])
 		return
 	}
+	// Users on a plan start with its budget. Plans can be worth a lot, so only admins get to pick one, and only admins get to find out which ones there are.
+	newUser.Budget = c.StartBudget
+	if newUser.Plan != "" {
+		if status, problem := c.admin(response, request); status != 0 {
+			Error(response, request, status, ErrorMessage[problem])
+			return
+		}
+		start, ok := c.Plans[newUser.Plan]
+		if !ok {
+			Error(response, request, http.StatusBadRequest, ErrorMessage["UnknownPlan"])
+			return
+		}
+		newUser.Budget = start
+	}
 	// Creating the new object.
-	newUser.ID = bson.NewObjectId()
-	newUser.Budget = 10
+	newUser.ID = types.NewID()
+	newUser.BudgetResetsAt = nil
+	newUser.DeactivatedAt = nil
 	newUser.CreatedAt = time.Now()
 	newUser.UpdatedAt = time.Now()
-	unique, err := c.DB.IsUnique(newUser)
+	newUser = c.Budget.Apply(newUser, newUser.CreatedAt)
+	ctx := request.Context()
+	unique, err := c.db().IsUnique(ctx, newUser)
 	if err != nil {
-		Error(response, request, http.StatusInternalServerError, "c.NewUser:"+ErrorMessage["db.IsUnique"])
+		DBError(response, request, err, "", "c.NewUser:"+ErrorMessage["db.IsUnique"])
 		return
 	}
 	if !unique {
 		Error(response, request, http.StatusConflict, ErrorMessage["TakenUsername"])
 		return
 	}
-	// And off it goes.
-	err = c.DB.Add(&newUser)
+	// And off it goes. If someone grabbed the username since IsUnique, this is where we find out.
+	err = c.db().AddUser(ctx, &newUser)
 	if err != nil {
-		Error(response, request, http.StatusInternalServerError, "c.NewUser:"+ErrorMessage["db.Add"])
+		DBError(response, request, err, "", "c.NewUser:"+ErrorMessage["db.AddUser"])
 		return
 	}
 	response.Header().Set("Content-Type", "application/json")
@@ -105,7 +244,7 @@ func (c *Controller) NewUser(response http.ResponseWriter, request *http.Request
 	json.NewEncoder(response).Encode(&newUser)
 }
 
-// GetUserByUsername returns a full User object based on the username.
+// GetUserByUsername returns a full User object based on the username, as in /users/by-username/{username}.
 func (c *Controller) GetUserByUsername(response http.ResponseWriter, request *http.Request) {
 	if request.Method != "GET" {
 		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"])
@@ -113,49 +252,198 @@ func (c *Controller) GetUserByUsername(response http.ResponseWriter, request *ht
 	}
 	// Gets the bit of the URL after the last "/"
 	user := path.Base(request.URL.Path)
-	query, err := c.DB.GetUser(user)
+	ctx := request.Context()
+	query, err := c.db().GetUser(ctx, user)
 	if err != nil {
-		if err.Error() == "not found" {
-			Error(response, request, http.StatusNotFound, ErrorMessage["UserNotFound"])
-			return
-		} else {
-			Error(response, request, http.StatusInternalServerError, "c.GetUserByUsername:"+ErrorMessage["db.GetUser"])
-			return
-		}
+		DBError(response, request, err, "UserNotFound", "c.GetUserByUsername:"+ErrorMessage["db.GetUser"])
+		return
+	}
+	// Now's as good a time as any to top up their budget.
+	query, err = c.refill(ctx, query)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetUserByUsername:"+ErrorMessage["db.SetBudget"])
+		return
 	}
 	response.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(response).Encode(&query)
 }
 
-// GetUserByID returns a full User object based on the ID.
+// GetUserByID returns a full User object based on the ID, or the username, as in /users/{idOrUsername}.
 func (c *Controller) GetUserByID(response http.ResponseWriter, request *http.Request) {
 	if request.Method != "GET" {
 		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"])
 		return
 	}
 	// Gets the bit of the URL after the last "/"
-	id := path.Base(request.URL.Path)
-	if !bson.IsObjectIdHex(id) {
-		Error(response, request, http.StatusBadRequest, ErrorMessage["BadObjectID"])
+	ref := path.Base(request.URL.Path)
+	if !isUserRef(ref) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUserRef"])
 		return
 	}
-	query := types.User{}
 	// Get user.
-	err := c.DB.Get(bson.ObjectIdHex(id), &query)
+	ctx := request.Context()
+	query, err := c.findUser(ctx, ref)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetUserByID:"+ErrorMessage["db.GetUserByID"])
+		return
+	}
+	// Now's as good a time as any to top up their budget.
+	query, err = c.refill(ctx, query)
 	if err != nil {
-		if err.Error() == "not found" {
-			Error(response, request, http.StatusNotFound, ErrorMessage["UserNotFound"])
+		DBError(response, request, err, "UserNotFound", "c.GetUserByID:"+ErrorMessage["db.SetBudget"])
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&query)
+}
+
+// UpdateUser changes a user's name, username, or both, given the user's ID as in /users/{id}, and returns the user. A new username has to be free, and carries over to every message the user has sent or received. Only the user themselves, as given by the X-Chatty-User header, gets to do that.
+func (c *Controller) UpdateUser(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "PATCH" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleasePATCH"])
+		return
+	}
+	caller := request.Header.Get(UserHeader)
+	if caller == "" {
+		Error(response, request, http.StatusUnauthorized, ErrorMessage["MissingUser"])
+		return
+	}
+	ref := path.Base(request.URL.Path)
+	if !isUserRef(ref) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUserRef"])
+		return
+	}
+	// Pointers, so we can tell a field that's missing from one that's blank.
+	var patch struct {
+		Name     *string `json:"name"`
+		Username *string `json:"username"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&patch); err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadJSON"])
+		return
+	}
+	switch {
+	case patch.Name == nil && patch.Username == nil:
+		Error(response, request, http.StatusBadRequest, ErrorMessage["EmptyPatch"])
+		return
+	case patch.Name != nil && *patch.Name == "":
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BlankName"])
+		return
+	case patch.Username != nil && !usernameFormat.MatchString(*patch.Username):
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUsername"])
+		return
+	case patch.Username != nil && isReserved(*patch.Username):
+		Error(response, request, http.StatusBadRequest, ErrorMessage["ReservedUsername"])
+		return
+	}
+	ctx := request.Context()
+	user, err := c.findUser(ctx, ref)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.UpdateUser:"+ErrorMessage["db.GetUserByID"])
+		return
+	}
+	switch {
+	case user.Username != caller:
+		Error(response, request, http.StatusForbidden, ErrorMessage["NotUser"])
+		return
+	case user.DeactivatedAt != nil:
+		Error(response, request, http.StatusGone, ErrorMessage["UserDeactivated"])
+		return
+	}
+	name, username := user.Name, user.Username
+	if patch.Name != nil {
+		name = *patch.Name
+	}
+	if patch.Username != nil && *patch.Username != user.Username {
+		username = *patch.Username
+		unique, err := c.db().IsUnique(ctx, types.User{Username: username})
+		if err != nil {
+			DBError(response, request, err, "", "c.UpdateUser:"+ErrorMessage["db.IsUnique"])
 			return
-		} else {
-			Error(response, request, http.StatusInternalServerError, "c.GetUserByID:"+ErrorMessage["db.Get"])
+		}
+		if !unique {
+			Error(response, request, http.StatusConflict, ErrorMessage["TakenUsername"])
 			return
 		}
 	}
+	// If someone grabbed the username since IsUnique, or the user got deactivated in the meantime, this is where we find out.
+	user, err = c.db().UpdateUser(ctx, user.ID, name, username, time.Now())
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.UpdateUser:"+ErrorMessage["db.UpdateUser"])
+		return
+	}
 	response.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(response).Encode(&query)
+	json.NewEncoder(response).Encode(&user)
+}
+
+// DeactivateUser deactivates a user, given the user's ID as in /users/{id}. Deactivated users can't send or receive messages, or change their account, and there's no coming back. Their account and username stay around, so the messages they've exchanged stay as they are for the other side of the conversation. Only the user themselves, as given by the X-Chatty-User header, gets to do that.
+func (c *Controller) DeactivateUser(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "DELETE" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseDELETE"])
+		return
+	}
+	caller := request.Header.Get(UserHeader)
+	if caller == "" {
+		Error(response, request, http.StatusUnauthorized, ErrorMessage["MissingUser"])
+		return
+	}
+	ref := path.Base(request.URL.Path)
+	if !isUserRef(ref) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUserRef"])
+		return
+	}
+	ctx := request.Context()
+	user, err := c.findUser(ctx, ref)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.DeactivateUser:"+ErrorMessage["db.GetUserByID"])
+		return
+	}
+	switch {
+	case user.Username != caller:
+		Error(response, request, http.StatusForbidden, ErrorMessage["NotUser"])
+		return
+	case user.DeactivatedAt != nil:
+		Error(response, request, http.StatusGone, ErrorMessage["UserDeactivated"])
+		return
+	}
+	if _, err := c.db().DeactivateUser(ctx, user.ID, time.Now()); err != nil {
+		DBError(response, request, err, "UserNotFound", "c.DeactivateUser:"+ErrorMessage["db.DeactivateUser"])
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// checkMessage returns what's wrong with a new message, or nothing if it's fine. From, To, and Body fields can't be empty. Body can't be larger than 280 characters. Priority has to be one we know, if there is one. We're lumping all of these checks together *before* making a DB call. Because we're cheap.
+func checkMessage(m types.Message) string {
+	errors := ""
+	if m.To == "" {
+		errors += ErrorMessage["EmptyTo"]
+	}
+	if m.From == "" {
+		errors += ErrorMessage["EmptyFrom"]
+	}
+	switch {
+	case m.Body == "":
+		errors += ErrorMessage["EmptyBody"]
+	case len(m.Body) > 280:
+		errors += ErrorMessage["LengthExceeded"]
+	}
+	if m.Priority != "" && m.Priority != types.PriorityNormal && m.Priority != types.PriorityHigh {
+		errors += " " + ErrorMessage["BadPriority"]
+	}
+	return strings.TrimSpace(errors)
 }
 
-// NewMessage creates a new message and returns the resulting object.
+// cantAfford answers for a sender whose budget falls short of a message's cost, saying by how much if they have any left at all.
+func cantAfford(response http.ResponseWriter, request *http.Request, message types.Message, sender types.User) {
+	if sender.Budget < 1 {
+		Error(response, request, http.StatusForbidden, ErrorMessage["BudgetExceeded"])
+		return
+	}
+	Error(response, request, http.StatusForbidden, fmt.Sprintf(ErrorMessage["CantAfford"], message.Cost, sender.Budget))
+}
+
+// NewMessage creates a new message and returns the resulting object, cost included.
 func (c *Controller) NewMessage(response http.ResponseWriter, request *http.Request) {
 	decoder := json.NewDecoder(request.Body)
 	var newMessage types.Message
@@ -164,95 +452,329 @@ func (c *Controller) NewMessage(response http.ResponseWriter, request *http.Requ
 		Error(response, request, http.StatusBadRequest, ErrorMessage["BadJSON"])
 		return
 	}
-	// From, To, and Body fields can't be empty. Body can't be larger than 280 characters. We're lumping all of these checks together *before* making a DB call. Because we're cheap.
-	if newMessage.To == "" || newMessage.From == "" || newMessage.Body == "" || len(newMessage.Body) > 280 {
-		errors := ""
-		if newMessage.To == "" {
-			errors += ErrorMessage["EmptyTo"]
-		}
-		if newMessage.From == "" {
-			errors += ErrorMessage["EmptyFrom"]
-		}
-		switch {
-		case newMessage.Body == "":
-			errors += ErrorMessage["EmptyBody"]
-		case len(newMessage.Body) > 280:
-			errors += ErrorMessage["LengthExceeded"]
-		}
-		Error(response, request, http.StatusBadRequest, strings.TrimSpace(errors))
+	if problem := checkMessage(newMessage); problem != "" {
+		Error(response, request, http.StatusBadRequest, problem)
 		return
 	}
+	newMessage.Cost = c.Pricing.Cost(newMessage)
 	// Hey database, is the sender real or just an imaginary friend? Habout the recipient?
-	sender, err := c.DB.GetUser(newMessage.From)
+	ctx := request.Context()
+	sender, err := c.db().GetUser(ctx, newMessage.From)
 	if err != nil {
-		if err.Error() == "not found" {
-			Error(response, request, http.StatusNotFound, ErrorMessage["SenderNotFound"])
-			return
-		} else {
-			Error(response, request, http.StatusInternalServerError, ErrorMessage["UnexpectedSender"])
-			return
-		}
-	} else if sender.Budget < 1 {
+		DBError(response, request, err, "SenderNotFound", ErrorMessage["UnexpectedSender"])
+		return
+	} else if sender.DeactivatedAt != nil {
+		Error(response, request, http.StatusForbidden, ErrorMessage["SenderDeactivated"])
+		return
+	}
+	sender, err = c.refill(ctx, sender)
+	if err != nil {
+		DBError(response, request, err, "SenderNotFound", "c.NewMessage:"+ErrorMessage["db.SetBudget"])
+		return
+	}
+	if sender.Budget < newMessage.Cost {
 		// No cheapskates here!
-		Error(response, request, http.StatusForbidden, ErrorMessage["BudgetExceeded"])
+		cantAfford(response, request, newMessage, sender)
 		return
 	}
-	_, err = c.DB.GetUser(newMessage.To)
+	recipient, err := c.db().GetUser(ctx, newMessage.To)
 	if err != nil {
-		if err.Error() == "not found" {
-			Error(response, request, http.StatusNotFound, ErrorMessage["RecipientNotFound"])
+		DBError(response, request, err, "RecipientNotFound", ErrorMessage["UnexpectedRecipient"])
+		return
+	} else if recipient.DeactivatedAt != nil {
+		Error(response, request, http.StatusForbidden, ErrorMessage["RecipientDeactivated"])
+		return
+	}
+	// Replies can only go to messages the sender was part of.
+	if newMessage.ReplyTo != "" {
+		newMessage.ReplyTo, err = types.ParseID(string(newMessage.ReplyTo))
+		if err != nil {
+			Error(response, request, http.StatusBadRequest, ErrorMessage["BadReplyTo"])
 			return
-		} else {
-			Error(response, request, http.StatusInternalServerError, ErrorMessage["UnexpectedRecipient"])
+		}
+		original, err := c.db().GetMessage(ctx, newMessage.ReplyTo)
+		if err != nil {
+			DBError(response, request, err, "ReplyToNotFound", "c.NewMessage:"+ErrorMessage["db.GetMessage"])
+			return
+		}
+		if original.From != newMessage.From && original.To != newMessage.From {
+			Error(response, request, http.StatusForbidden, ErrorMessage["ReplyToForbidden"])
+			return
+		}
+		if original.DeletedAt != nil {
+			Error(response, request, http.StatusGone, ErrorMessage["ReplyToDeleted"])
 			return
 		}
 	}
 	// Filling in the rest of the field.
-	newMessage.ID = bson.NewObjectId()
+	newMessage.ID = types.NewID()
 	newMessage.SentAt = time.Now()
-	// And boom! New message!
-	c.DB.Add(&newMessage)
+	newMessage.DeliveredAt = nil
+	newMessage.ReadAt = nil
+	newMessage.EditedAt = nil
+	newMessage.DeletedAt = nil
+	newMessage.Revisions = nil
+	// And boom! New message! Charging the sender and storing the message happen in one go, so the budget check above is only a shortcut: this is the one that counts.
+	err = c.db().SendMessage(ctx, &newMessage)
+	if errors.Is(err, store.ErrBudgetExhausted) {
+		// Someone else spent the budget in the meantime. Let's see what's left.
+		if sender, err := c.db().GetUserByID(ctx, sender.ID); err == nil {
+			cantAfford(response, request, newMessage, sender)
+			return
+		}
+	}
 	if err != nil {
-		Error(response, request, http.StatusInternalServerError, "c.NewMessage:"+ErrorMessage["db.Add"])
+		DBError(response, request, err, "SenderNotFound", "c.NewMessage:"+ErrorMessage["db.SendMessage"])
 		return
 	}
-	// We charge the sender only after checking that there were no errors in adding the message.
-	err = c.DB.DecreaseBudget(sender)
-	if err != nil {
-		if err.Error() == "budget discrepancy" {
-			log.Println("Budget discrepancy.", err)
-		} else {
-			log.Println("Unknown error in dbDecreaseBudget call.", err)
-		}
+	// Spending budget may have started the clock on the next refill. The message is out either way, so there's nothing to tell the client if this fails.
+	charged := sender
+	charged.Budget -= newMessage.Cost
+	if _, err := c.refill(ctx, charged); err != nil {
+		log.Println("Couldn't refill the budget of", sender.Username, "after a send.", err)
 	}
 	response.Header().Set("Content-Type", "application/json")
 	response.WriteHeader(http.StatusCreated)
 	json.NewEncoder(response).Encode(&newMessage)
 }
 
-// GetMessages gets all messages addressed to a specific user.
+// QuoteMessage says what a message would cost to send, without sending it. It takes the same message NewMessage does, and checks it the same way short of looking anyone up, so a message that gets a quote is one the sender only needs the budget for.
+func (c *Controller) QuoteMessage(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleasePOST"])
+		return
+	}
+	var message types.Message
+	if err := json.NewDecoder(request.Body).Decode(&message); err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadJSON"])
+		return
+	}
+	if problem := checkMessage(message); problem != "" {
+		Error(response, request, http.StatusBadRequest, problem)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&types.Quote{Cost: c.Pricing.Cost(message)})
+}
+
+// GetMessages gets a page of the messages matching the to, from, since, until, and unread parameters, oldest first unless order is desc. Any combination works, as long as there's a recipient or a sender. The limit parameter sets the page size, and the cursor parameter picks up where a previous page's next cursor left off. The next page is also linked from the Link header, as per RFC 8288. Listings by recipient come with how many messages they haven't read yet, and when the recipient is the one asking, the messages on the page count as delivered.
 func (c *Controller) GetMessages(response http.ResponseWriter, request *http.Request) {
-	// Hey, look, a param!
-	user := request.URL.Query().Get("to")
-	_, err := c.DB.GetUser(user)
+	// Hey, look, params!
+	params := request.URL.Query()
+	q, problem := messageQuery(params)
+	if problem != "" {
+		Error(response, request, http.StatusBadRequest, ErrorMessage[problem])
+		return
+	}
+	if q.To == "" && q.From == "" {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["EmptyToFrom"])
+		return
+	}
+	ctx := request.Context()
+	if q.To != "" {
+		if _, err := c.db().GetUser(ctx, q.To); err != nil {
+			DBError(response, request, err, "UserNotFound", "c.GetMessages:"+ErrorMessage["UnexpectedRecipient"])
+			return
+		}
+	}
+	if q.From != "" {
+		if _, err := c.db().GetUser(ctx, q.From); err != nil {
+			DBError(response, request, err, "SenderNotFound", "c.GetMessages:"+ErrorMessage["UnexpectedSender"])
+			return
+		}
+	}
+	messages, err := c.db().FindMessages(ctx, q)
 	if err != nil {
-		if err.Error() == "not found" {
-			Error(response, request, http.StatusNotFound, ErrorMessage["UserNotFound"])
+		DBError(response, request, err, "UserNotFound", "c.GetMessages:"+ErrorMessage["db.FindMessages"])
+		return
+	}
+	if q.To != "" {
+		if request.Header.Get(UserHeader) == q.To {
+			now := time.Now()
+			ids := []types.ID{}
+			for i, m := range messages.Entries {
+				if m.To == q.To && m.DeliveredAt == nil {
+					ids = append(ids, m.ID)
+					messages.Entries[i].DeliveredAt = &now
+				}
+			}
+			if len(ids) > 0 {
+				if err := c.db().DeliverMessages(ctx, ids, now); err != nil {
+					DBError(response, request, err, "MessageNotFound", "c.GetMessages:"+ErrorMessage["db.DeliverMessages"])
+					return
+				}
+			}
+		}
+		unread, err := c.db().CountUnread(ctx, q.To)
+		if err != nil {
+			DBError(response, request, err, "UserNotFound", "c.GetMessages:"+ErrorMessage["db.CountUnread"])
 			return
-		} else {
-			Error(response, request, http.StatusInternalServerError, "c.GetMessages:"+ErrorMessage["UnexpectedRecipient"])
+		}
+		messages.Unread = &unread
+	}
+	writePage(response, request, params, messages)
+}
+
+// GetSentMessages gets a page of the messages a user has sent, given the user's ID as in /users/{id}/sent. It takes the same parameters as GetMessages, except from.
+func (c *Controller) GetSentMessages(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"])
+		return
+	}
+	// Gets the bit of the URL before the last "/"
+	ref := path.Base(path.Dir(request.URL.Path))
+	if !isUserRef(ref) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUserRef"])
+		return
+	}
+	params := request.URL.Query()
+	q, problem := messageQuery(params)
+	if problem != "" {
+		Error(response, request, http.StatusBadRequest, ErrorMessage[problem])
+		return
+	}
+	ctx := request.Context()
+	user, err := c.findUser(ctx, ref)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetSentMessages:"+ErrorMessage["db.GetUserByID"])
+		return
+	}
+	q.From = user.Username
+	messages, err := c.db().FindMessages(ctx, q)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetSentMessages:"+ErrorMessage["db.FindMessages"])
+		return
+	}
+	writePage(response, request, params, messages)
+}
+
+// GetConversation gets a page of the messages two users have exchanged, either way, given their usernames as in /conversations/{userA}/{userB}. It takes the same parameters as GetMessages, except to and from.
+func (c *Controller) GetConversation(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"])
+		return
+	}
+	// The two usernames, and nothing else.
+	users := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/conversations/"), "/"), "/")
+	if len(users) != 2 || users[0] == "" || users[1] == "" {
+		Error(response, request, http.StatusNotFound, ErrorMessage["NoSuchPath"])
+		return
+	}
+	params := request.URL.Query()
+	q, problem := messageQuery(params)
+	if problem != "" {
+		Error(response, request, http.StatusBadRequest, ErrorMessage[problem])
+		return
+	}
+	q.From, q.To, q.EitherWay = users[0], users[1], true
+	ctx := request.Context()
+	for _, user := range []string{q.From, q.To} {
+		if _, err := c.db().GetUser(ctx, user); err != nil {
+			DBError(response, request, err, "UserNotFound", "c.GetConversation:"+ErrorMessage["db.GetUser"])
 			return
 		}
 	}
-	messages, err := c.DB.GetMessagesByUser(user)
+	messages, err := c.db().FindMessages(ctx, q)
 	if err != nil {
-		Error(response, request, http.StatusInternalServerError, "c.GetMessages:"+ErrorMessage["db.GetMessagesByUser"])
+		DBError(response, request, err, "UserNotFound", "c.GetConversation:"+ErrorMessage["db.FindMessages"])
+		return
+	}
+	writePage(response, request, params, messages)
+}
+
+// GetConversations lists everyone a user has exchanged messages with, most recent first, along with the last message and how many are still unread. The user's ID goes as in /users/{id}/conversations.
+func (c *Controller) GetConversations(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"])
+		return
+	}
+	// Gets the bit of the URL before the last "/"
+	ref := path.Base(path.Dir(request.URL.Path))
+	if !isUserRef(ref) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUserRef"])
+		return
+	}
+	ctx := request.Context()
+	user, err := c.findUser(ctx, ref)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetConversations:"+ErrorMessage["db.GetUserByID"])
+		return
+	}
+	conversations, err := c.db().Conversations(ctx, user.Username)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetConversations:"+ErrorMessage["db.Conversations"])
 		return
 	}
 	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&conversations)
+}
+
+// writePage writes out a page of a message listing. If there's a next page, the Link header points to it, as per RFC 8288, using the same params plus the new cursor.
+func writePage(response http.ResponseWriter, request *http.Request, params url.Values, messages types.Messages) {
+	if messages.Next != "" {
+		params.Set("cursor", messages.Next)
+		next := url.URL{Path: request.URL.Path, RawQuery: params.Encode()}
+		response.Header().Set("Link", "<"+next.String()+">; rel=\"next\"")
+	}
+	response.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(response).Encode(&messages)
 }
 
+// messageQuery turns the query parameters of a message listing into a store.MessageQuery. If any of them is malformed, it returns the ErrorMessage key saying which.
+func messageQuery(params url.Values) (store.MessageQuery, string) {
+	q := store.MessageQuery{
+		To:    params.Get("to"),
+		From:  params.Get("from"),
+		Limit: DefaultPageSize,
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxPageSize {
+			return q, "BadLimit"
+		}
+		q.Limit = n
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		after, err := store.ParseCursor(cursor)
+		if err != nil {
+			return q, "BadCursor"
+		}
+		q.After = &after
+	}
+	if since := params.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return q, "BadSince"
+		}
+		q.Since = t
+	}
+	if until := params.Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return q, "BadUntil"
+		}
+		q.Until = t
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Since.Before(q.Until) {
+		return q, "BadTimeRange"
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return q, "BadOrder"
+	}
+	switch params.Get("unread") {
+	case "", "false":
+	case "true":
+		q.Unread = true
+	default:
+		return q, "BadUnread"
+	}
+	return q, ""
+}
+
 // GetMessage returns a full Message object based on the ID.
 func (c *Controller) GetMessage(response http.ResponseWriter, request *http.Request) {
 	if request.Method != "GET" {
@@ -260,24 +782,292 @@ func (c *Controller) GetMessage(response http.ResponseWriter, request *http.Requ
 		return
 	}
 	// Do I need to keep writing these comments? I'll just assume you got the hang of it by now.
-	id := path.Base(request.URL.Path)
-	if !bson.IsObjectIdHex(id) {
+	id, err := types.ParseID(path.Base(request.URL.Path))
+	if err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadObjectID"])
+		return
+	}
+	ctx := request.Context()
+	query, err := c.db().GetMessage(ctx, id)
+	if err != nil {
+		DBError(response, request, err, "MessageNotFound", "c.GetMessage:"+ErrorMessage["db.GetMessage"])
+		return
+	}
+	if query.DeletedAt != nil {
+		Error(response, request, http.StatusGone, ErrorMessage["MessageDeleted"])
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&query)
+}
+
+// EditMessage replaces the body of a message, given its ID as in /message/{id}, and returns it. The old body is kept in the message's revisions. Only the sender, as given by the X-Chatty-User header, gets to do that, and only within EditWindow of sending it. The new body follows the same rules as a new message's.
+func (c *Controller) EditMessage(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "PATCH" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleasePATCH"])
+		return
+	}
+	caller := request.Header.Get(UserHeader)
+	if caller == "" {
+		Error(response, request, http.StatusUnauthorized, ErrorMessage["MissingUser"])
+		return
+	}
+	id, err := types.ParseID(path.Base(request.URL.Path))
+	if err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadObjectID"])
+		return
+	}
+	var edit struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&edit); err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadJSON"])
+		return
+	}
+	switch {
+	case edit.Body == "":
+		Error(response, request, http.StatusBadRequest, ErrorMessage["EmptyBody"])
+		return
+	case len(edit.Body) > 280:
+		Error(response, request, http.StatusBadRequest, ErrorMessage["LengthExceeded"])
+		return
+	}
+	ctx := request.Context()
+	message, err := c.db().GetMessage(ctx, id)
+	if err != nil {
+		DBError(response, request, err, "MessageNotFound", "c.EditMessage:"+ErrorMessage["db.GetMessage"])
+		return
+	}
+	now := time.Now()
+	switch {
+	case message.DeletedAt != nil:
+		Error(response, request, http.StatusGone, ErrorMessage["MessageDeleted"])
+		return
+	case message.From != caller:
+		Error(response, request, http.StatusForbidden, ErrorMessage["NotSender"])
+		return
+	case c.EditWindow > 0 && now.Sub(message.SentAt) > c.EditWindow:
+		Error(response, request, http.StatusForbidden, ErrorMessage["EditWindowPassed"])
+		return
+	}
+	// Edits don't get charged, so they can't make a message worth more than it is. Both sides go by today's rates, so rates going up doesn't stop edits that change nothing about the price.
+	edited := message
+	edited.Body = edit.Body
+	if c.Pricing.Cost(edited) > c.Pricing.Cost(message) {
+		Error(response, request, http.StatusForbidden, ErrorMessage["EditCostsMore"])
+		return
+	}
+	// If the sender deletes it in the meantime, this is where we find out.
+	message, err = c.db().EditMessage(ctx, id, edit.Body, now)
+	if err != nil {
+		DBError(response, request, err, "MessageNotFound", "c.EditMessage:"+ErrorMessage["db.EditMessage"])
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&message)
+}
+
+// DeleteMessage deletes a message, given its ID as in /message/{id}, for both sender and recipient. A tombstone stays behind, so replies to it still have something to hang from, but it's gone from every listing. Only the sender, as given by the X-Chatty-User header, gets to do that.
+func (c *Controller) DeleteMessage(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "DELETE" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseDELETE"])
+		return
+	}
+	caller := request.Header.Get(UserHeader)
+	if caller == "" {
+		Error(response, request, http.StatusUnauthorized, ErrorMessage["MissingUser"])
+		return
+	}
+	id, err := types.ParseID(path.Base(request.URL.Path))
+	if err != nil {
 		Error(response, request, http.StatusBadRequest, ErrorMessage["BadObjectID"])
 		return
 	}
-	query := types.Message{}
-	err := c.DB.Get(bson.ObjectIdHex(id), &query)
+	ctx := request.Context()
+	message, err := c.db().GetMessage(ctx, id)
 	if err != nil {
-		if err.Error() == "not found" {
-			Error(response, request, http.StatusNotFound, ErrorMessage["MessageNotFound"])
+		DBError(response, request, err, "MessageNotFound", "c.DeleteMessage:"+ErrorMessage["db.GetMessage"])
+		return
+	}
+	switch {
+	case message.DeletedAt != nil:
+		Error(response, request, http.StatusGone, ErrorMessage["MessageDeleted"])
+		return
+	case message.From != caller:
+		Error(response, request, http.StatusForbidden, ErrorMessage["NotSender"])
+		return
+	}
+	if _, err := c.db().DeleteMessage(ctx, id, time.Now()); err != nil {
+		DBError(response, request, err, "MessageNotFound", "c.DeleteMessage:"+ErrorMessage["db.DeleteMessage"])
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// ReadMessage marks a message as read, given its ID as in /message/{id}/read, and returns it. Only the recipient, as given by the X-Chatty-User header, gets to do that. Reading a message again changes nothing.
+func (c *Controller) ReadMessage(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleasePOST"])
+		return
+	}
+	caller := request.Header.Get(UserHeader)
+	if caller == "" {
+		Error(response, request, http.StatusUnauthorized, ErrorMessage["MissingUser"])
+		return
+	}
+	// Gets the bit of the URL before the last "/"
+	id, err := types.ParseID(path.Base(path.Dir(request.URL.Path)))
+	if err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadObjectID"])
+		return
+	}
+	ctx := request.Context()
+	message, err := c.db().GetMessage(ctx, id)
+	if err != nil {
+		DBError(response, request, err, "MessageNotFound", "c.ReadMessage:"+ErrorMessage["db.GetMessage"])
+		return
+	}
+	if message.DeletedAt != nil {
+		Error(response, request, http.StatusGone, ErrorMessage["MessageDeleted"])
+		return
+	}
+	if message.To != caller {
+		Error(response, request, http.StatusForbidden, ErrorMessage["NotRecipient"])
+		return
+	}
+	message, err = c.db().ReadMessage(ctx, id, time.Now())
+	if err != nil {
+		DBError(response, request, err, "MessageNotFound", "c.ReadMessage:"+ErrorMessage["db.ReadMessage"])
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&message)
+}
+
+// ReadMessages marks every unread message a user has received as read, up to and including the one in the upTo field, given the user's ID as in /users/{id}/read. The optional from field narrows it down to the messages from one sender. Only the user themselves, as given by the X-Chatty-User header, gets to do that. It says how many messages were marked, and how many are left unread.
+func (c *Controller) ReadMessages(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleasePOST"])
+		return
+	}
+	caller := request.Header.Get(UserHeader)
+	if caller == "" {
+		Error(response, request, http.StatusUnauthorized, ErrorMessage["MissingUser"])
+		return
+	}
+	// Gets the bit of the URL before the last "/"
+	ref := path.Base(path.Dir(request.URL.Path))
+	if !isUserRef(ref) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUserRef"])
+		return
+	}
+	var body struct {
+		UpTo string `json:"upTo"`
+		From string `json:"from"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadJSON"])
+		return
+	}
+	upTo, err := types.ParseID(body.UpTo)
+	if err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUpTo"])
+		return
+	}
+	ctx := request.Context()
+	user, err := c.findUser(ctx, ref)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.ReadMessages:"+ErrorMessage["db.GetUserByID"])
+		return
+	}
+	if user.Username != caller {
+		Error(response, request, http.StatusForbidden, ErrorMessage["NotRecipient"])
+		return
+	}
+	last, err := c.db().GetMessage(ctx, upTo)
+	if err != nil {
+		DBError(response, request, err, "MessageNotFound", "c.ReadMessages:"+ErrorMessage["db.GetMessage"])
+		return
+	}
+	if last.To != user.Username {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUpTo"])
+		return
+	}
+	if body.From != "" {
+		if _, err := c.db().GetUser(ctx, body.From); err != nil {
+			DBError(response, request, err, "SenderNotFound", "c.ReadMessages:"+ErrorMessage["UnexpectedSender"])
 			return
-		} else {
-			Error(response, request, http.StatusInternalServerError, "c.GetMessage:"+ErrorMessage["db.Get"])
+		}
+	}
+	through := store.CursorOf(last)
+	read, err := c.db().ReadMessages(ctx, store.MessageQuery{To: user.Username, From: body.From, Through: &through}, time.Now())
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.ReadMessages:"+ErrorMessage["db.ReadMessages"])
+		return
+	}
+	unread, err := c.db().CountUnread(ctx, user.Username)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.ReadMessages:"+ErrorMessage["db.CountUnread"])
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(map[string]int{"read": read, "unread": unread})
+}
+
+// MaxThreadSize is the most replies GetReplies returns in one go.
+const MaxThreadSize = 500
+
+// GetReplies returns the reply tree of a message, given its ID as in /message/{id}/replies: the message, its replies, their replies, and so on, oldest first at every level. Threads bigger than MaxThreadSize get cut short, and the messages whose replies were left out are marked as truncated.
+func (c *Controller) GetReplies(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"])
+		return
+	}
+	// Gets the bit of the URL before the last "/"
+	id, err := types.ParseID(path.Base(path.Dir(request.URL.Path)))
+	if err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadObjectID"])
+		return
+	}
+	ctx := request.Context()
+	message, err := c.db().GetMessage(ctx, id)
+	if err != nil {
+		DBError(response, request, err, "MessageNotFound", "c.GetReplies:"+ErrorMessage["db.GetMessage"])
+		return
+	}
+	if message.DeletedAt != nil {
+		Error(response, request, http.StatusGone, ErrorMessage["MessageDeleted"])
+		return
+	}
+	// One level of the tree at a time, so it takes as many calls as the thread is deep.
+	root := &types.Thread{Message: message, Replies: []*types.Thread{}}
+	level := map[types.ID]*types.Thread{id: root}
+	for size := 0; len(level) > 0; {
+		ids := make([]types.ID, 0, len(level))
+		for id := range level {
+			ids = append(ids, id)
+		}
+		replies, err := c.db().Replies(ctx, ids)
+		if err != nil {
+			DBError(response, request, err, "MessageNotFound", "c.GetReplies:"+ErrorMessage["db.Replies"])
 			return
 		}
+		next := map[types.ID]*types.Thread{}
+		for _, reply := range replies {
+			parent := level[reply.ReplyTo]
+			if size >= MaxThreadSize {
+				parent.Truncated = true
+				continue
+			}
+			thread := &types.Thread{Message: reply, Replies: []*types.Thread{}}
+			parent.Replies = append(parent.Replies, thread)
+			next[reply.ID] = thread
+			size++
+		}
+		level = next
 	}
 	response.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(response).Encode(&query)
+	json.NewEncoder(response).Encode(root)
 }
 
 // MessageRouter routes requests to /messages to either NewMessage or GetMessages based on the request method.
@@ -289,3 +1079,151 @@ func (c *Controller) MessageRouter(response http.ResponseWriter, request *http.R
 		c.GetMessages(response, request)
 	}
 }
+
+// MessageByIDRouter routes requests to /message/ based on what comes after the message ID: /replies goes to GetReplies, and /read to ReadMessage. Nothing goes to GetMessage, EditMessage, or DeleteMessage based on the request method.
+func (c *Controller) MessageByIDRouter(response http.ResponseWriter, request *http.Request) {
+	switch path.Base(request.URL.Path) {
+	case "replies":
+		c.GetReplies(response, request)
+	case "read":
+		c.ReadMessage(response, request)
+	default:
+		switch request.Method {
+		case "PATCH":
+			c.EditMessage(response, request)
+		case "DELETE":
+			c.DeleteMessage(response, request)
+		default:
+			c.GetMessage(response, request)
+		}
+	}
+}
+
+// GetLedger lists every change to a user's budget, oldest first, each with its reason and the message it was for, if any. Only the user themselves can see it, so the request needs their username in the X-Chatty-User header, unless it comes with the admin token instead. The user's ID goes as in /users/{id}/ledger.
+func (c *Controller) GetLedger(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"])
+		return
+	}
+	caller := request.Header.Get(UserHeader)
+	admin := request.Header.Get("Authorization") != ""
+	if admin {
+		if status, problem := c.admin(response, request); status != 0 {
+			Error(response, request, status, ErrorMessage[problem])
+			return
+		}
+	} else if caller == "" {
+		Error(response, request, http.StatusUnauthorized, ErrorMessage["MissingUser"])
+		return
+	}
+	// Gets the bit of the URL before the last "/"
+	ref := path.Base(path.Dir(request.URL.Path))
+	if !isUserRef(ref) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUserRef"])
+		return
+	}
+	ctx := request.Context()
+	user, err := c.findUser(ctx, ref)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetLedger:"+ErrorMessage["db.GetUserByID"])
+		return
+	}
+	if !admin && user.Username != caller {
+		Error(response, request, http.StatusForbidden, ErrorMessage["NotLedgerOwner"])
+		return
+	}
+	// Any refill that's due goes in first, so the ledger ends at the budget they'd see.
+	if _, err := c.refill(ctx, user); err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetLedger:"+ErrorMessage["db.SetBudget"])
+		return
+	}
+	entries, err := c.db().Ledger(ctx, user.ID)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GetLedger:"+ErrorMessage["db.Ledger"])
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&entries)
+}
+
+// GrantBudget gives a user more budget, or takes some away, and returns the user. It goes as in /users/{id}/budget with {"amount": 5, "reason": "..."}, where a negative amount takes budget away. It's for admins only, so the request needs the admin token in the Authorization header. The change goes in the user's ledger as a grant, along with the reason.
+func (c *Controller) GrantBudget(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		Error(response, request, http.StatusMethodNotAllowed, ErrorMessage["PleasePOST"])
+		return
+	}
+	if status, problem := c.admin(response, request); status != 0 {
+		Error(response, request, status, ErrorMessage[problem])
+		return
+	}
+	// Gets the bit of the URL before the last "/"
+	ref := path.Base(path.Dir(request.URL.Path))
+	if !isUserRef(ref) {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadUserRef"])
+		return
+	}
+	var grant struct {
+		Amount int    `json:"amount"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&grant); err != nil {
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadJSON"])
+		return
+	}
+	switch {
+	case grant.Amount == 0:
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BadAmount"])
+		return
+	case strings.TrimSpace(grant.Reason) == "":
+		Error(response, request, http.StatusBadRequest, ErrorMessage["BlankReason"])
+		return
+	}
+	ctx := request.Context()
+	user, err := c.findUser(ctx, ref)
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GrantBudget:"+ErrorMessage["db.GetUserByID"])
+		return
+	}
+	if user.DeactivatedAt != nil {
+		Error(response, request, http.StatusGone, ErrorMessage["UserDeactivated"])
+		return
+	}
+	user, err = c.db().GrantBudget(ctx, user.ID, grant.Amount, grant.Reason, time.Now())
+	if errors.Is(err, store.ErrBudgetExhausted) {
+		Error(response, request, http.StatusConflict, ErrorMessage["RevokeTooLarge"])
+		return
+	}
+	if err != nil {
+		DBError(response, request, err, "UserNotFound", "c.GrantBudget:"+ErrorMessage["db.GrantBudget"])
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(&user)
+}
+
+// UserRouter routes requests to /users/ based on what comes after the user ID or username: /sent goes to GetSentMessages, /conversations to GetConversations, /read to ReadMessages, /ledger to GetLedger, and /budget to GrantBudget. Nothing goes to GetUserByID, UpdateUser, or DeactivateUser based on the request method. /users/by-username/{username} goes to GetUserByUsername. It goes by how many bits the path has, so users named after any of these still work.
+func (c *Controller) UserRouter(response http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/users/"), "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == ByUsername:
+		c.GetUserByUsername(response, request)
+	case len(parts) == 2 && parts[1] == "sent":
+		c.GetSentMessages(response, request)
+	case len(parts) == 2 && parts[1] == "conversations":
+		c.GetConversations(response, request)
+	case len(parts) == 2 && parts[1] == "read":
+		c.ReadMessages(response, request)
+	case len(parts) == 2 && parts[1] == "ledger":
+		c.GetLedger(response, request)
+	case len(parts) == 2 && parts[1] == "budget":
+		c.GrantBudget(response, request)
+	case len(parts) == 1 && request.Method == "PATCH":
+		c.UpdateUser(response, request)
+	case len(parts) == 1 && request.Method == "DELETE":
+		c.DeactivateUser(response, request)
+	case len(parts) == 1:
+		c.GetUserByID(response, request)
+	default:
+		Error(response, request, http.StatusNotFound, ErrorMessage["NoSuchPath"])
+	}
+}
@@ -2,23 +2,30 @@ package ctrl
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	// "github.com/ellenkorbes/chatty/db"
+	"github.com/ellenkorbes/chatty/budget"
 	db "github.com/ellenkorbes/chatty/nodb"
+	"github.com/ellenkorbes/chatty/pricing"
+	"github.com/ellenkorbes/chatty/store"
 	"github.com/ellenkorbes/chatty/types"
 )
 
 // TestListAllUsers tests the functioning of the ListAllUsers controller method.
 func TestListAllUsers(t *testing.T) {
-	d := db.NewSession("")
-	defer d.Session.Close()
+	d := db.NewFakeSession()
+	defer d.Close()
 	ctrl := NewController(d)
 	// Creating a fake HTTP server.
 	ts := httptest.NewServer(http.HandlerFunc(ctrl.ListAllUsers))
@@ -43,8 +50,8 @@ func TestListAllUsers(t *testing.T) {
 
 // TestListAllMessages tests the functioning of the ListAllMessages controller method.
 func TestListAllMessages(t *testing.T) {
-	d := db.NewSession("")
-	defer d.Session.Close()
+	d := db.NewFakeSession()
+	defer d.Close()
 	ctrl := NewController(d)
 	// Creating a fake HTTP server.
 	ts := httptest.NewServer(http.HandlerFunc(ctrl.ListAllMessages))
@@ -70,7 +77,7 @@ func TestListAllMessages(t *testing.T) {
 // TestNewUser tests the functioning of the NewUser controller method.
 func TestNewUser(t *testing.T) {
 	d := db.NewSession("")
-	defer d.Session.Close()
+	defer d.Close()
 	ctrl := NewController(d)
 	// Creating a fake HTTP server.
 	ts := httptest.NewServer(http.HandlerFunc(ctrl.NewUser))
@@ -102,14 +109,14 @@ func TestNewUser(t *testing.T) {
 
 // TestGetUserByID tests the functioning of the GetUserByID controller method.
 func TestGetUserByID(t *testing.T) {
-	d := db.NewSession("")
-	defer d.Session.Close()
+	d := db.NewFakeSession()
+	defer d.Close()
 	ctrl := NewController(d)
 	// Creating a fake HTTP server.
 	ts := httptest.NewServer(http.HandlerFunc(ctrl.GetUserByID))
 	defer ts.Close()
 	// And a fake GET request.
-	response, err := http.Get(ts.URL + "/5a8d75057d9b53706595116a")
+	response, err := http.Get(ts.URL + "/0161b891-1d85-7b4c-9133-da73a7113224")
 	if err != nil {
 		t.Error(fmt.Sprintln("Unknown error:", err))
 	}
@@ -126,16 +133,106 @@ func TestGetUserByID(t *testing.T) {
 	}
 }
 
+// TestUserRouterByUsername tests that users can be reached by ID or by username under /users/, and by username under /users/by-username/, even when their username is also the name of a sub-resource.
+func TestUserRouterByUsername(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", ctrl.NewUser)
+	mux.HandleFunc("/users/", ctrl.UserRouter)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	// A user with an awkward username.
+	response, err := http.Post(ts.URL+"/users", "application/json", strings.NewReader(`{"name": "Sent", "username": "sent"}`))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		t.Fatal(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusCreated))
+	}
+	good := map[string]string{
+		"/users/0161b891-1d85-7b4c-9133-da73a7113224": "orange",
+		"/users/orange":             "orange",
+		"/users/orange/":            "orange",
+		"/users/by-username/orange": "orange",
+		"/users/sent":               "sent",
+		"/users/by-username/sent":   "sent",
+	}
+	for path, expected := range good {
+		response, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		user := types.User{}
+		json.NewDecoder(response.Body).Decode(&user)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK || user.Username != expected {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %s\tExpected: %d - %s", path, response.StatusCode, user.Username, http.StatusOK, expected))
+		}
+	}
+	// The sub-resources take usernames too.
+	response, err = http.Get(ts.URL + "/users/orange/sent")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	page := types.Messages{}
+	json.NewDecoder(response.Body).Decode(&page)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || len(page.Entries) != 1 || page.Entries[0].From != "orange" {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - the message from orange", response.StatusCode, page.Entries, http.StatusOK))
+	}
+	// And now for some bad requests.
+	bad := map[string]struct {
+		status int
+		detail string
+	}{
+		"/users/tangerine":                                   {http.StatusNotFound, ErrorMessage["UserNotFound"]},
+		"/users/by-username/tangerine":                       {http.StatusNotFound, ErrorMessage["UserNotFound"]},
+		"/users/Orange!":                                     {http.StatusBadRequest, ErrorMessage["BadUserRef"]},
+		"/users/orange/sent/more":                            {http.StatusNotFound, ErrorMessage["NoSuchPath"]},
+		"/users/0161b891-1d85-7b4c-9133-da73a7113299":        {http.StatusNotFound, ErrorMessage["UserNotFound"]},
+		"/users/by-username/0161b891-1d85-7b4c-9133-da73a71": {http.StatusNotFound, ErrorMessage["UserNotFound"]},
+	}
+	for path, expected := range bad {
+		response, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %s\tExpected: %d - %s", path, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+	// Usernames that would make /users/{idOrUsername} ambiguous can't be taken.
+	for _, username := range []string{"a161b891-1d85-7b4c-9133-da73a7113299", "by-username"} {
+		response, err := http.Post(ts.URL+"/users", "application/json", strings.NewReader(`{"name": "Sneaky", "username": "`+username+`"}`))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest || problem.Detail != ErrorMessage["ReservedUsername"] {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %s\tExpected: %d - %s", username, response.StatusCode, problem.Detail, http.StatusBadRequest, ErrorMessage["ReservedUsername"]))
+		}
+	}
+}
+
 // TestGetMessage tests the functioning of the GetMessage controller method.
 func TestGetMessage(t *testing.T) {
-	d := db.NewSession("")
-	defer d.Session.Close()
+	d := db.NewFakeSession()
+	defer d.Close()
 	ctrl := NewController(d)
 	// Creating a fake HTTP server.
 	ts := httptest.NewServer(http.HandlerFunc(ctrl.GetMessage))
 	defer ts.Close()
 	// And a fake GET request.
-	response, err := http.Get(ts.URL + "/5a93000c7d9b532f98e8bba2")
+	response, err := http.Get(ts.URL + "/0161ce38-3255-79c1-b289-e7522195b362")
 	if err != nil {
 		t.Error(fmt.Sprintln("Unknown error:", err))
 	}
@@ -154,8 +251,8 @@ func TestGetMessage(t *testing.T) {
 
 // TestMessageRouter tests the functioning of the MessageRouter controller method. This calls either NewMessage or GetMessages depending on whether we receive a POST or a GET request, so we need to test both cases.
 func TestMessageRouter(t *testing.T) {
-	d := db.NewSession("")
-	defer d.Session.Close()
+	d := db.NewFakeSession()
+	defer d.Close()
 	ctrl := NewController(d)
 	// Creating a fake HTTP server.
 	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageRouter))
@@ -200,3 +297,1709 @@ func TestMessageRouter(t *testing.T) {
 		t.Error(fmt.Sprintf("Actual: %s - %s - %s\tExpected: %s - %s - %s", actualPost.To, actualPost.From, actualPost.Body, expectedPost.To, expectedPost.From, expectedPost.Body))
 	}
 }
+
+// TestNewUserIsStored tests that a user created by NewUser can be read back, and that its username can't be taken twice.
+func TestNewUserIsStored(t *testing.T) {
+	d := db.NewSession("")
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server for each endpoint.
+	tsNew := httptest.NewServer(http.HandlerFunc(ctrl.NewUser))
+	defer tsNew.Close()
+	tsGet := httptest.NewServer(http.HandlerFunc(ctrl.GetUserByID))
+	defer tsGet.Close()
+	// First POST creates the user.
+	response, err := http.Post(tsNew.URL, "application/json", bytes.NewBuffer(db.FakeUser))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	created := types.User{}
+	json.NewDecoder(response.Body).Decode(&created)
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		t.Fatal(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusCreated))
+	}
+	// Reading it back by ID should yield the same user.
+	response, err = http.Get(tsGet.URL + "/" + created.ID.String())
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	stored := types.User{}
+	json.NewDecoder(response.Body).Decode(&stored)
+	response.Body.Close()
+	if stored.ID != created.ID || stored.Username != created.Username || stored.Budget != 10 {
+		t.Error(fmt.Sprintf("Actual: %s - %s - %d\tExpected: %s - %s - %d", stored.ID, stored.Username, stored.Budget, created.ID, created.Username, 10))
+	}
+	// And a second POST with the same username should be rejected.
+	response, err = http.Post(tsNew.URL, "application/json", bytes.NewBuffer(db.FakeUser))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusConflict {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusConflict))
+	}
+}
+
+// TestNewUserIsActive tests that new users start out active, whatever deactivatedAt the client sent.
+func TestNewUserIsActive(t *testing.T) {
+	d := db.NewSession("")
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.NewUser))
+	defer ts.Close()
+	response, err := http.Post(ts.URL, "application/json", strings.NewReader(`{"name": "Orange", "username": "orange", "deactivatedAt": "2020-01-01T00:00:00Z"}`))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	created := types.User{}
+	json.NewDecoder(response.Body).Decode(&created)
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated || created.DeactivatedAt != nil {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", response.StatusCode, created.DeactivatedAt, http.StatusCreated, nil))
+	}
+	stored, err := d.GetUser(context.Background(), "orange")
+	if err != nil || stored.DeactivatedAt != nil {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", stored.DeactivatedAt, err, nil, nil))
+	}
+}
+
+// TestNewMessageConcurrentBudget tests that a burst of concurrent sends from the same user never takes their budget below zero.
+func TestNewMessageConcurrentBudget(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageRouter))
+	defer ts.Close()
+	sender, err := d.GetUser(context.Background(), "orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	// Way more requests than the sender can afford, all at once.
+	attempts := sender.Budget * 5
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := http.Post(ts.URL, "application/json", bytes.NewBuffer(db.FakeMessage))
+			if err != nil {
+				t.Error(fmt.Sprintln("Unknown error:", err))
+				return
+			}
+			response.Body.Close()
+			statuses <- response.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	// Exactly as many sends as the budget allowed should have gone through, and the rest should have been refused.
+	count := map[int]int{}
+	for status := range statuses {
+		count[status]++
+	}
+	if count[http.StatusCreated] != sender.Budget || count[http.StatusForbidden] != attempts-sender.Budget {
+		t.Error(fmt.Sprintf("Actual: %d created - %d forbidden\tExpected: %d created - %d forbidden", count[http.StatusCreated], count[http.StatusForbidden], sender.Budget, attempts-sender.Budget))
+	}
+	after, err := d.GetUser(context.Background(), "orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if after.Budget != 0 {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", after.Budget, 0))
+	}
+	inbox, err := d.FindMessages(context.Background(), store.MessageQuery{To: "banana"})
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	// The fake session already has one message addressed to banana.
+	if len(inbox.Entries) != sender.Budget+1 {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", len(inbox.Entries), sender.Budget+1))
+	}
+}
+
+// failingDB wraps a working DBInterface and makes the methods listed in fail return an error. GetUser only fails for the usernames listed in failUsers, so sender and recipient lookups can be broken separately.
+type failingDB struct {
+	DBInterface
+	fail      map[string]bool
+	failUsers map[string]bool
+}
+
+var errFailingDB = errors.New("the database is on fire")
+
+func (f failingDB) AddUser(ctx context.Context, user *types.User) error {
+	if f.fail["AddUser"] {
+		return errFailingDB
+	}
+	return f.DBInterface.AddUser(ctx, user)
+}
+
+func (f failingDB) GetUser(ctx context.Context, user string) (types.User, error) {
+	if f.failUsers[user] {
+		return types.User{}, errFailingDB
+	}
+	return f.DBInterface.GetUser(ctx, user)
+}
+
+func (f failingDB) SendMessage(ctx context.Context, message *types.Message) error {
+	if f.fail["SendMessage"] {
+		return errFailingDB
+	}
+	return f.DBInterface.SendMessage(ctx, message)
+}
+
+func (f failingDB) FindMessages(ctx context.Context, q store.MessageQuery) (types.Messages, error) {
+	if f.fail["FindMessages"] {
+		return types.Messages{}, errFailingDB
+	}
+	return f.DBInterface.FindMessages(ctx, q)
+}
+
+func (f failingDB) IsUnique(ctx context.Context, user types.User) (bool, error) {
+	if f.fail["IsUnique"] {
+		return false, errFailingDB
+	}
+	return f.DBInterface.IsUnique(ctx, user)
+}
+
+// TestStorageErrors tests that every storage error in NewUser, NewMessage, and GetMessages turns into a 500 Problem, and that a failed send doesn't cost the sender anything.
+func TestStorageErrors(t *testing.T) {
+	newUser := []byte(`{"name":"Apple","username":"apple"}`)
+	cases := []struct {
+		name      string
+		fail      []string
+		failUsers []string
+		method    string
+		query     string
+		body      []byte
+	}{
+		{"NewUser/IsUnique", []string{"IsUnique"}, nil, "POST", "/users", newUser},
+		{"NewUser/AddUser", []string{"AddUser"}, nil, "POST", "/users", newUser},
+		{"NewMessage/sender", nil, []string{"orange"}, "POST", "/messages", db.FakeMessage},
+		{"NewMessage/recipient", nil, []string{"banana"}, "POST", "/messages", db.FakeMessage},
+		{"NewMessage/SendMessage", []string{"SendMessage"}, nil, "POST", "/messages", db.FakeMessage},
+		{"GetMessages/GetUser", nil, []string{"orange"}, "GET", "/messages?to=orange", nil},
+		{"GetMessages/FindMessages", []string{"FindMessages"}, nil, "GET", "/messages?to=orange", nil},
+	}
+	for _, tc := range cases {
+		d := db.NewFakeSession()
+		f := failingDB{d, map[string]bool{}, map[string]bool{}}
+		for _, name := range tc.fail {
+			f.fail[name] = true
+		}
+		for _, user := range tc.failUsers {
+			f.failUsers[user] = true
+		}
+		ctrl := NewController(f)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/users", ctrl.NewUser)
+		mux.HandleFunc("/messages", ctrl.MessageRouter)
+		// Creating a fake HTTP server.
+		ts := httptest.NewServer(mux)
+		before, _ := d.GetUser(context.Background(), "orange")
+		request, err := http.NewRequest(tc.method, ts.URL+tc.query, bytes.NewBuffer(tc.body))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		ts.Close()
+		if response.StatusCode != http.StatusInternalServerError || problem.Status != http.StatusInternalServerError {
+			t.Error(fmt.Sprintf("%s: Actual: %d - %d\tExpected: %d", tc.name, response.StatusCode, problem.Status, http.StatusInternalServerError))
+		}
+		after, _ := d.GetUser(context.Background(), "orange")
+		if after.Budget != before.Budget {
+			t.Error(fmt.Sprintf("%s: Actual budget: %d\tExpected budget: %d", tc.name, after.Budget, before.Budget))
+		}
+	}
+}
+
+// racyDB wraps a working DBInterface and pretends every username is free, the way IsUnique would if another request grabbed the username right after it checked.
+type racyDB struct {
+	DBInterface
+}
+
+func (r racyDB) IsUnique(ctx context.Context, user types.User) (bool, error) {
+	return true, nil
+}
+
+// TestNewUserDuplicateKey tests that a duplicate username caught by the storage layer itself still turns into a 409.
+func TestNewUserDuplicateKey(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(racyDB{d})
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.NewUser))
+	defer ts.Close()
+	// FakeUser is already in the fake session.
+	response, err := http.Post(ts.URL, "application/json", bytes.NewBuffer(db.FakeUser))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	problem := types.Problem{}
+	json.NewDecoder(response.Body).Decode(&problem)
+	response.Body.Close()
+	if response.StatusCode != http.StatusConflict || problem.Detail != ErrorMessage["TakenUsername"] {
+		t.Error(fmt.Sprintf("Actual: %d - %s\tExpected: %d - %s", response.StatusCode, problem.Detail, http.StatusConflict, ErrorMessage["TakenUsername"]))
+	}
+}
+
+// slowDB wraps a working DBInterface and makes GetUser hang until its context gives up.
+type slowDB struct {
+	DBInterface
+}
+
+func (s slowDB) GetUser(ctx context.Context, user string) (types.User, error) {
+	<-ctx.Done()
+	return types.User{}, ctx.Err()
+}
+
+// TestTimeout tests that a database call that outlives the controller's timeout turns into a 504.
+func TestTimeout(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(slowDB{d})
+	ctrl.Timeout = 10 * time.Millisecond
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageRouter))
+	defer ts.Close()
+	response, err := http.Get(ts.URL + "?to=orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	problem := types.Problem{}
+	json.NewDecoder(response.Body).Decode(&problem)
+	response.Body.Close()
+	if response.StatusCode != http.StatusGatewayTimeout || problem.Detail != ErrorMessage["Timeout"] {
+		t.Error(fmt.Sprintf("Actual: %d - %s\tExpected: %d - %s", response.StatusCode, problem.Detail, http.StatusGatewayTimeout, ErrorMessage["Timeout"]))
+	}
+}
+
+// sluggishDB wraps a working DBInterface and makes GetUser take a while, unless its context gives up first.
+type sluggishDB struct {
+	DBInterface
+	delay time.Duration
+}
+
+func (s sluggishDB) GetUser(ctx context.Context, user string) (types.User, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.DBInterface.GetUser(ctx, user)
+	case <-ctx.Done():
+		return types.User{}, ctx.Err()
+	}
+}
+
+// TestTimeoutPerCall tests that the timeout applies to each database call on its own, so a request whose calls all fit in it goes through even when together they don't.
+func TestTimeoutPerCall(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(sluggishDB{d, 60 * time.Millisecond})
+	ctrl.Timeout = 100 * time.Millisecond
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageRouter))
+	defer ts.Close()
+	// Sending looks up both the sender and the recipient.
+	response, err := http.Post(ts.URL, "application/json", bytes.NewBuffer(db.FakeMessage))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusCreated))
+	}
+}
+
+// TestGetMessagesPagination tests that following the Link header page by page goes through a whole inbox in order, ties on sentAt included, and that malformed limits and cursors get a 400.
+func TestGetMessagesPagination(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageRouter))
+	defer ts.Close()
+	// Five more messages for banana, which already has one. Some of them sent at the very same time.
+	sentAt := time.Now()
+	for i := 0; i < 5; i++ {
+		message := types.Message{From: "orange", To: "banana", Body: fmt.Sprint("Message ", i), SentAt: sentAt.Add(time.Duration(i/2) * time.Second)}
+		if err := d.SendMessage(context.Background(), &message); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	expected, err := d.FindMessages(context.Background(), store.MessageQuery{To: "banana"})
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	actual := []types.ID{}
+	pages := 0
+	for next := "/?to=banana&limit=2"; next != ""; pages++ {
+		response, err := http.Get(ts.URL + next)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		page := types.Messages{}
+		json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK || len(page.Entries) > 2 || pages > 3 {
+			t.Fatal(fmt.Sprintf("Actual: %d - %d messages - page %d\tExpected: %d - at most %d messages - at most page %d", response.StatusCode, len(page.Entries), pages, http.StatusOK, 2, 3))
+		}
+		for _, m := range page.Entries {
+			actual = append(actual, m.ID)
+		}
+		next = ""
+		if link := response.Header.Get("Link"); link != "" {
+			next = strings.TrimPrefix(strings.TrimSuffix(link, `>; rel="next"`), "<")
+		}
+		if (next == "") != (page.Next == "") {
+			t.Error(fmt.Sprintf("Actual: %q - %q\tExpected: both or neither", response.Header.Get("Link"), page.Next))
+		}
+	}
+	if len(actual) != len(expected.Entries) || pages != 3 {
+		t.Fatal(fmt.Sprintf("Actual: %d messages in %d pages\tExpected: %d messages in %d pages", len(actual), pages, len(expected.Entries), 3))
+	}
+	for i, m := range expected.Entries {
+		if i > 0 && !store.Less(expected.Entries[i-1], m) {
+			t.Error(fmt.Sprintf("Actual: %s before %s\tExpected: sorted by sentAt and ID", expected.Entries[i-1].ID, m.ID))
+		}
+		if actual[i] != m.ID {
+			t.Error(fmt.Sprintf("Actual: %s\tExpected: %s", actual[i], m.ID))
+		}
+	}
+	// And now for some bad params.
+	bad := map[string]string{
+		"?to=banana&limit=0":          ErrorMessage["BadLimit"],
+		"?to=banana&limit=101":        ErrorMessage["BadLimit"],
+		"?to=banana&limit=two":        ErrorMessage["BadLimit"],
+		"?to=banana&cursor=nope":      ErrorMessage["BadCursor"],
+		"?to=banana&cursor=e30":       ErrorMessage["BadCursor"],
+		"?to=banana&cursor=%2F%2F%2F": ErrorMessage["BadCursor"],
+	}
+	for query, detail := range bad {
+		response, err := http.Get(ts.URL + query)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest || problem.Detail != detail {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %s\tExpected: %d - %s", query, response.StatusCode, problem.Detail, http.StatusBadRequest, detail))
+		}
+	}
+}
+
+// TestGetMessagesFilters tests that the from, since, until, and order parameters combine with each other and with to, and that malformed values get a Problem response.
+func TestGetMessagesFilters(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageRouter))
+	defer ts.Close()
+	// Three more messages for orange, one a day after the one it already has.
+	sent := []types.ID{"0161b896-9746-7a0d-b2c9-5aa144c1d0ff"}
+	for day := 22; day <= 24; day++ {
+		message := types.Message{From: "banana", To: "orange", Body: "Hi.", SentAt: time.Date(2018, 2, day, 12, 0, 0, 0, time.UTC)}
+		if err := d.SendMessage(context.Background(), &message); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		sent = append(sent, message.ID)
+	}
+	good := map[string][]types.ID{
+		"?to=orange&order=desc": {sent[3], sent[2], sent[1], sent[0]},
+		"?from=banana&since=2018-02-22T00:00:00Z&until=2018-02-24T00:00:00Z": {sent[1], sent[2]},
+		"?to=orange&from=banana&since=2018-02-23T12:00:00Z&order=asc":        {sent[2], sent[3]},
+		"?from=orange":           {"0161ce38-3255-79c1-b289-e7522195b362"},
+		"?to=orange&from=orange": {},
+		"?to=orange&until=2018-02-22T12:00:00%2B01:00&order=desc&limit=1": {sent[0]},
+	}
+	for query, expected := range good {
+		response, err := http.Get(ts.URL + query)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		page := types.Messages{}
+		json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		actual := []types.ID{}
+		for _, m := range page.Entries {
+			actual = append(actual, m.ID)
+		}
+		if response.StatusCode != http.StatusOK || fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %v\tExpected: %d - %v", query, response.StatusCode, actual, http.StatusOK, expected))
+		}
+	}
+	bad := map[string]struct {
+		status int
+		detail string
+	}{
+		"?to=orange&since=yesterday":                                       {http.StatusBadRequest, ErrorMessage["BadSince"]},
+		"?to=orange&until=2018-02-22":                                      {http.StatusBadRequest, ErrorMessage["BadUntil"]},
+		"?to=orange&since=2018-02-23T00:00:00Z&until=2018-02-22T00:00:00Z": {http.StatusBadRequest, ErrorMessage["BadTimeRange"]},
+		"?to=orange&order=up":                                              {http.StatusBadRequest, ErrorMessage["BadOrder"]},
+		"?since=2018-02-23T00:00:00Z":                                      {http.StatusBadRequest, ErrorMessage["EmptyToFrom"]},
+		"?to=orange&from=kiwi":                                             {http.StatusNotFound, ErrorMessage["SenderNotFound"]},
+		"?to=kiwi&from=orange":                                             {http.StatusNotFound, ErrorMessage["UserNotFound"]},
+	}
+	for query, expected := range bad {
+		response, err := http.Get(ts.URL + query)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		// A key missing from ErrorMessage would match its blank detail, so blank never counts.
+		if response.StatusCode != expected.status || problem.Detail == "" || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %s\tExpected: %d - %s", query, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+}
+
+// TestUserRouter tests that UserRouter sends user lookups to GetUserByID and outbox listings to GetSentMessages, and that the outbox pages just like the inbox.
+func TestUserRouter(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.UserRouter))
+	defer ts.Close()
+	// The user first.
+	response, err := http.Get(ts.URL + "/users/0161b891-1d85-7b4c-9133-da73a7113224")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	read, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if actual, expected := strings.TrimSpace(string(read)), string(db.FakeUser); err != nil || actual != expected {
+		t.Error(fmt.Sprintf("Actual:\n%sExpected:\n%s", actual, expected))
+	}
+	// Then what they've sent, one per page. Orange has already sent one message, here's another.
+	message := types.Message{From: "orange", To: "banana", Body: "Hi again.", SentAt: time.Now()}
+	if err := d.SendMessage(context.Background(), &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	response, err = http.Get(ts.URL + "/users/0161b891-1d85-7b4c-9133-da73a7113224/sent?limit=1&order=desc")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	page := types.Messages{}
+	json.NewDecoder(response.Body).Decode(&page)
+	response.Body.Close()
+	link := response.Header.Get("Link")
+	if response.StatusCode != http.StatusOK || len(page.Entries) != 1 || page.Entries[0].ID != message.ID || !strings.HasPrefix(link, "</users/0161b891-1d85-7b4c-9133-da73a7113224/sent?") {
+		t.Fatal(fmt.Sprintf("Actual: %d - %v - %s\tExpected: %d - [%s] - a link to the next page", response.StatusCode, page.Entries, link, http.StatusOK, message.ID))
+	}
+	response, err = http.Get(ts.URL + strings.TrimPrefix(strings.TrimSuffix(link, `>; rel="next"`), "<"))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	page = types.Messages{}
+	json.NewDecoder(response.Body).Decode(&page)
+	response.Body.Close()
+	if len(page.Entries) != 1 || page.Entries[0].ID != "0161ce38-3255-79c1-b289-e7522195b362" || page.Next != "" {
+		t.Error(fmt.Sprintf("Actual: %v - %q\tExpected: [%s] - %q", page.Entries, page.Next, "0161ce38-3255-79c1-b289-e7522195b362", ""))
+	}
+	// And now for some bad requests.
+	bad := map[string]struct {
+		method string
+		status int
+		detail string
+	}{
+		"/users/Orange!/sent":                                       {"GET", http.StatusBadRequest, ErrorMessage["BadUserRef"]},
+		"/users/0161b891-1d85-7b4c-9133-da73a7113299/sent":          {"GET", http.StatusNotFound, ErrorMessage["UserNotFound"]},
+		"/users/0161b891-1d85-7b4c-9133-da73a7113224/sent?order=up": {"GET", http.StatusBadRequest, ErrorMessage["BadOrder"]},
+		"/users/0161b891-1d85-7b4c-9133-da73a7113224/sent":          {"POST", http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"]},
+	}
+	for path, expected := range bad {
+		request, err := http.NewRequest(expected.method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s\tActual: %d - %s\tExpected: %d - %s", expected.method, path, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+}
+
+// TestGetConversation tests that a conversation has the messages going both ways, in order, whichever way round the users are given.
+func TestGetConversation(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.GetConversation))
+	defer ts.Close()
+	expected := []types.ID{"0161b896-9746-7a0d-b2c9-5aa144c1d0ff", "0161ce38-3255-79c1-b289-e7522195b362"}
+	for _, path := range []string{"/conversations/orange/banana", "/conversations/banana/orange"} {
+		response, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		page := types.Messages{}
+		json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		actual := []types.ID{}
+		for _, m := range page.Entries {
+			actual = append(actual, m.ID)
+		}
+		if response.StatusCode != http.StatusOK || fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %v\tExpected: %d - %v", path, response.StatusCode, actual, http.StatusOK, expected))
+		}
+	}
+	// Anything but two usernames is nowhere, even when "conversations" or "extra" could pass for one.
+	bad := map[string]string{
+		"/conversations/orange/kiwi":         ErrorMessage["UserNotFound"],
+		"/conversations/banana":              ErrorMessage["NoSuchPath"],
+		"/conversations/":                    ErrorMessage["NoSuchPath"],
+		"/conversations//banana":             ErrorMessage["NoSuchPath"],
+		"/conversations/orange/banana/extra": ErrorMessage["NoSuchPath"],
+	}
+	if err := d.AddUser(context.Background(), &types.User{Name: "Conversations", Username: "conversations", CreatedAt: time.Now(), UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	for path, expected := range bad {
+		response, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound || problem.Detail != expected {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %s\tExpected: %d - %s", path, response.StatusCode, problem.Detail, http.StatusNotFound, expected))
+		}
+	}
+}
+
+// TestGetConversations tests that a user's conversations come most recent first, each with its last message and unread count.
+func TestGetConversations(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.UserRouter))
+	defer ts.Close()
+	apple := types.User{Name: "Apple", Username: "apple", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(context.Background(), &apple); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	message := types.Message{From: "apple", To: "orange", Body: "Psst.", SentAt: time.Now()}
+	if err := d.SendMessage(context.Background(), &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	response, err := http.Get(ts.URL + "/users/0161b891-1d85-7b4c-9133-da73a7113224/conversations")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	actual := []types.Conversation{}
+	json.NewDecoder(response.Body).Decode(&actual)
+	response.Body.Close()
+	expected := []types.Conversation{
+		{With: "apple", Last: message, Unread: 1},
+		{With: "banana", Last: types.Message{ID: "0161ce38-3255-79c1-b289-e7522195b362"}, Unread: 1},
+	}
+	if response.StatusCode != http.StatusOK || len(actual) != len(expected) {
+		t.Fatal(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", response.StatusCode, actual, http.StatusOK, expected))
+	}
+	for i, c := range actual {
+		if c.With != expected[i].With || c.Last.ID != expected[i].Last.ID || c.Unread != expected[i].Unread {
+			t.Error(fmt.Sprintf("Actual: %s - %s - %d\tExpected: %s - %s - %d", c.With, c.Last.ID, c.Unread, expected[i].With, expected[i].Last.ID, expected[i].Unread))
+		}
+	}
+}
+
+// TestReplies tests that replies are only accepted for messages the sender was part of, and that they show up in the reply tree in order.
+func TestReplies(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating fake HTTP servers, one to send and one to look up.
+	send := httptest.NewServer(http.HandlerFunc(ctrl.MessageRouter))
+	defer send.Close()
+	lookup := httptest.NewServer(http.HandlerFunc(ctrl.MessageByIDRouter))
+	defer lookup.Close()
+	apple := types.User{Name: "Apple", Username: "apple", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(context.Background(), &apple); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	// post sends a message and returns the status code along with the resulting message or problem.
+	post := func(from, to string, replyTo types.ID) (int, types.Message, types.Problem) {
+		body, _ := json.Marshal(map[string]string{"from": from, "to": to, "body": "Re.", "replyTo": string(replyTo)})
+		response, err := http.Post(send.URL, "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		defer response.Body.Close()
+		read, _ := ioutil.ReadAll(response.Body)
+		message, problem := types.Message{}, types.Problem{}
+		json.Unmarshal(read, &message)
+		json.Unmarshal(read, &problem)
+		return response.StatusCode, message, problem
+	}
+	// Banana sent this one to orange.
+	original := types.ID("0161b896-9746-7a0d-b2c9-5aa144c1d0ff")
+	status, reply, _ := post("orange", "banana", original)
+	if status != http.StatusCreated || reply.ReplyTo != original {
+		t.Fatal(fmt.Sprintf("Actual: %d - %s\tExpected: %d - %s", status, reply.ReplyTo, http.StatusCreated, original))
+	}
+	status, replyToReply, _ := post("banana", "orange", reply.ID)
+	if status != http.StatusCreated {
+		t.Fatal(fmt.Sprintf("Actual: %d\tExpected: %d", status, http.StatusCreated))
+	}
+	bad := []struct {
+		from    string
+		replyTo types.ID
+		status  int
+		detail  string
+	}{
+		{"apple", original, http.StatusForbidden, ErrorMessage["ReplyToForbidden"]},
+		{"orange", "nope", http.StatusBadRequest, ErrorMessage["BadReplyTo"]},
+		{"orange", "0161b896-9746-7a0d-b2c9-5aa144c1d000", http.StatusNotFound, ErrorMessage["ReplyToNotFound"]},
+	}
+	for _, b := range bad {
+		if status, _, problem := post(b.from, "banana", b.replyTo); status != b.status || problem.Detail != b.detail {
+			t.Error(fmt.Sprintf("%s - %s\tActual: %d - %s\tExpected: %d - %s", b.from, b.replyTo, status, problem.Detail, b.status, b.detail))
+		}
+	}
+	// And now the tree.
+	response, err := http.Get(lookup.URL + "/message/" + original.String() + "/replies")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	thread := types.Thread{}
+	json.NewDecoder(response.Body).Decode(&thread)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || thread.Message.ID != original || len(thread.Replies) != 1 || thread.Replies[0].Message.ID != reply.ID ||
+		len(thread.Replies[0].Replies) != 1 || thread.Replies[0].Replies[0].Message.ID != replyToReply.ID || len(thread.Replies[0].Replies[0].Replies) != 0 {
+		read, _ := json.Marshal(&thread)
+		t.Error(fmt.Sprintf("Actual: %d - %s\tExpected: %d - %s replied to by %s, replied to by %s", response.StatusCode, read, http.StatusOK, original, reply.ID, replyToReply.ID))
+	}
+}
+
+// TestRepliesTruncated tests that reply trees stop at MaxThreadSize replies, and say so.
+func TestRepliesTruncated(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageByIDRouter))
+	defer ts.Close()
+	apple := types.User{Name: "Apple", Username: "apple", Budget: MaxThreadSize + 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(context.Background(), &apple); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	original := types.ID("0161ce38-3255-79c1-b289-e7522195b362")
+	for i := 0; i <= MaxThreadSize; i++ {
+		reply := types.Message{From: "apple", To: "orange", Body: "Me too.", SentAt: time.Now(), ReplyTo: original}
+		if err := d.SendMessage(context.Background(), &reply); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	response, err := http.Get(ts.URL + "/message/" + original.String() + "/replies")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	thread := types.Thread{}
+	json.NewDecoder(response.Body).Decode(&thread)
+	response.Body.Close()
+	if len(thread.Replies) != MaxThreadSize || !thread.Truncated {
+		t.Error(fmt.Sprintf("Actual: %d - %t\tExpected: %d - %t", len(thread.Replies), thread.Truncated, MaxThreadSize, true))
+	}
+}
+
+// TestReadMessage tests that the recipient, and only the recipient, can mark a message as read, and that the inbox listing keeps count.
+func TestReadMessage(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/messages", ctrl.MessageRouter)
+	mux.HandleFunc("/message/", ctrl.MessageByIDRouter)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	// Orange lists their inbox, which delivers the message there but doesn't read it.
+	request, err := http.NewRequest("GET", ts.URL+"/messages?to=orange", nil)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	request.Header.Set(UserHeader, "orange")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	page := types.Messages{}
+	json.NewDecoder(response.Body).Decode(&page)
+	response.Body.Close()
+	if len(page.Entries) != 1 || page.Entries[0].DeliveredAt == nil || page.Entries[0].ReadAt != nil || page.Unread == nil || *page.Unread != 1 {
+		t.Fatal(fmt.Sprintf("Actual: %v - %v\tExpected: a delivered, unread message - %d unread", page.Entries, page.Unread, 1))
+	}
+	stored, _ := d.GetMessage(context.Background(), "0161b896-9746-7a0d-b2c9-5aa144c1d0ff")
+	// JSON only goes down to the millisecond.
+	if stored.DeliveredAt == nil || !stored.DeliveredAt.Truncate(time.Millisecond).Equal(*page.Entries[0].DeliveredAt) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", stored.DeliveredAt, page.Entries[0].DeliveredAt))
+	}
+	// Now for some bad requests.
+	bad := []struct {
+		method string
+		path   string
+		caller string
+		status int
+		detail string
+	}{
+		{"POST", "/message/0161b896-9746-7a0d-b2c9-5aa144c1d0ff/read", "", http.StatusUnauthorized, ErrorMessage["MissingUser"]},
+		{"POST", "/message/0161b896-9746-7a0d-b2c9-5aa144c1d0ff/read", "banana", http.StatusForbidden, ErrorMessage["NotRecipient"]},
+		{"POST", "/message/0161b896-9746-7a0d-b2c9-5aa144c1d0aa/read", "orange", http.StatusNotFound, ErrorMessage["MessageNotFound"]},
+		{"POST", "/message/orange/read", "orange", http.StatusBadRequest, ErrorMessage["BadObjectID"]},
+		{"GET", "/message/0161b896-9746-7a0d-b2c9-5aa144c1d0ff/read", "orange", http.StatusMethodNotAllowed, ErrorMessage["PleasePOST"]},
+		{"GET", "/messages?to=orange&unread=maybe", "", http.StatusBadRequest, ErrorMessage["BadUnread"]},
+	}
+	for _, expected := range bad {
+		request, err := http.NewRequest(expected.method, ts.URL+expected.path, nil)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		if expected.caller != "" {
+			request.Header.Set(UserHeader, expected.caller)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s\tActual: %d - %s\tExpected: %d - %s", expected.method, expected.path, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+	// Then they read it.
+	request, err = http.NewRequest("POST", ts.URL+"/message/0161b896-9746-7a0d-b2c9-5aa144c1d0ff/read", nil)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	request.Header.Set(UserHeader, "orange")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	message := types.Message{}
+	json.NewDecoder(response.Body).Decode(&message)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || message.ReadAt == nil || message.DeliveredAt == nil || !message.DeliveredAt.Equal(stored.DeliveredAt.Truncate(time.Millisecond)) {
+		t.Fatal(fmt.Sprintf("Actual: %d - %v - %v\tExpected: %d - a read receipt - %v", response.StatusCode, message.ReadAt, message.DeliveredAt, http.StatusOK, stored.DeliveredAt))
+	}
+	// Which leaves nothing unread.
+	response, err = http.Get(ts.URL + "/messages?to=orange&unread=true")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	page = types.Messages{}
+	json.NewDecoder(response.Body).Decode(&page)
+	response.Body.Close()
+	if len(page.Entries) != 0 || page.Unread == nil || *page.Unread != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %d", page.Entries, page.Unread, "[]", 0))
+	}
+}
+
+// TestReadMessages tests that a user can mark everything up to a message as read in one go, optionally from one sender only, and nobody else's messages.
+func TestReadMessages(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.UserRouter))
+	defer ts.Close()
+	apple := types.User{Name: "Apple", Username: "apple", Budget: 5, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(context.Background(), &apple); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	// Orange already has one unread message from banana. Here's a few more.
+	start := time.Date(2018, 2, 26, 13, 0, 0, 0, time.UTC)
+	sent := []types.Message{
+		{From: "apple", To: "orange", Body: "First.", SentAt: start},
+		{From: "banana", To: "orange", Body: "Second.", SentAt: start.Add(time.Second)},
+		{From: "apple", To: "orange", Body: "Third.", SentAt: start.Add(2 * time.Second)},
+	}
+	for i := range sent {
+		if err := d.SendMessage(context.Background(), &sent[i]); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	post := func(caller string, body string) (*http.Response, error) {
+		request, err := http.NewRequest("POST", ts.URL+"/users/0161b891-1d85-7b4c-9133-da73a7113224/read", strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if caller != "" {
+			request.Header.Set(UserHeader, caller)
+		}
+		return http.DefaultClient.Do(request)
+	}
+	// Everything from apple up to the second message, which is just the first one. Then everything else up to it, and then nothing new.
+	steps := []struct {
+		body   string
+		read   int
+		unread int
+	}{
+		{`{"upTo": "` + string(sent[1].ID) + `", "from": "apple"}`, 1, 3},
+		{`{"upTo": "` + string(sent[1].ID) + `"}`, 2, 1},
+		{`{"upTo": "` + string(sent[1].ID) + `"}`, 0, 1},
+	}
+	for _, step := range steps {
+		response, err := post("orange", step.body)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		actual := map[string]int{}
+		json.NewDecoder(response.Body).Decode(&actual)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK || actual["read"] != step.read || actual["unread"] != step.unread {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %v\tExpected: %d - map[read:%d unread:%d]", step.body, response.StatusCode, actual, http.StatusOK, step.read, step.unread))
+		}
+	}
+	if last, _ := d.GetMessage(context.Background(), sent[2].ID); last.ReadAt != nil {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", last.ReadAt, nil))
+	}
+	// And now for some bad requests.
+	bad := []struct {
+		caller string
+		body   string
+		status int
+		detail string
+	}{
+		{"", `{"upTo": "` + string(sent[2].ID) + `"}`, http.StatusUnauthorized, ErrorMessage["MissingUser"]},
+		{"banana", `{"upTo": "` + string(sent[2].ID) + `"}`, http.StatusForbidden, ErrorMessage["NotRecipient"]},
+		{"orange", `{"upTo": "0161ce38-3255-79c1-b289-e7522195b362"}`, http.StatusBadRequest, ErrorMessage["BadUpTo"]},
+		{"orange", `{"upTo": "soon"}`, http.StatusBadRequest, ErrorMessage["BadUpTo"]},
+		{"orange", `{"upTo": "0161ce38-3255-79c1-b289-e7522195b3aa"}`, http.StatusNotFound, ErrorMessage["MessageNotFound"]},
+		{"orange", `{"upTo": "` + string(sent[2].ID) + `", "from": "kiwi"}`, http.StatusNotFound, ErrorMessage["SenderNotFound"]},
+		{"orange", `upTo`, http.StatusBadRequest, ErrorMessage["BadJSON"]},
+	}
+	for _, expected := range bad {
+		response, err := post(expected.caller, expected.body)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s\tActual: %d - %s\tExpected: %d - %s", expected.caller, expected.body, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+}
+
+// TestEditMessage tests that the sender can edit a message while the edit window is open, keeping the old bodies around, and that nobody else can.
+func TestEditMessage(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageByIDRouter))
+	defer ts.Close()
+	message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now(), Cost: 1}
+	if err := d.SendMessage(context.Background(), &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	patch := func(id types.ID, caller string, body string) (*http.Response, error) {
+		request, err := http.NewRequest("PATCH", ts.URL+"/message/"+string(id), strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if caller != "" {
+			request.Header.Set(UserHeader, caller)
+		}
+		return http.DefaultClient.Do(request)
+	}
+	// Two edits, two revisions.
+	for _, body := range []string{"Hello.", "Hello there."} {
+		response, err := patch(message.ID, "orange", `{"body": "`+body+`"}`)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatal(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusOK))
+		}
+	}
+	response, err := http.Get(ts.URL + "/message/" + string(message.ID))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	actual := types.Message{}
+	json.NewDecoder(response.Body).Decode(&actual)
+	response.Body.Close()
+	if actual.Body != "Hello there." || actual.EditedAt == nil || len(actual.Revisions) != 2 || actual.Revisions[0].Body != "Hi." || actual.Revisions[1].Body != "Hello." || !actual.Revisions[0].WrittenAt.Equal(message.SentAt.Truncate(time.Millisecond)) {
+		t.Error(fmt.Sprintf("Actual: %q - %v - %v\tExpected: %q - an edit time - [Hi. Hello.]", actual.Body, actual.EditedAt, actual.Revisions, "Hello there."))
+	}
+	// And now for some bad requests.
+	bad := []struct {
+		id     types.ID
+		caller string
+		body   string
+		status int
+		detail string
+	}{
+		{message.ID, "", `{"body": "Hey."}`, http.StatusUnauthorized, ErrorMessage["MissingUser"]},
+		{message.ID, "banana", `{"body": "Hey."}`, http.StatusForbidden, ErrorMessage["NotSender"]},
+		{message.ID, "orange", `{"body": ""}`, http.StatusBadRequest, ErrorMessage["EmptyBody"]},
+		{message.ID, "orange", `{"body": "` + strings.Repeat("a", 281) + `"}`, http.StatusBadRequest, ErrorMessage["LengthExceeded"]},
+		{message.ID, "orange", `body`, http.StatusBadRequest, ErrorMessage["BadJSON"]},
+		{"0161ce38-3255-79c1-b289-e7522195b362", "orange", `{"body": "Hey."}`, http.StatusForbidden, ErrorMessage["EditWindowPassed"]},
+		{"0161ce38-3255-79c1-b289-e7522195b3aa", "orange", `{"body": "Hey."}`, http.StatusNotFound, ErrorMessage["MessageNotFound"]},
+	}
+	for _, expected := range bad {
+		response, err := patch(expected.id, expected.caller, expected.body)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s %.20s\tActual: %d - %s\tExpected: %d - %s", expected.id, expected.caller, expected.body, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+	// With no edit window, old messages are fair game too.
+	ctrl.EditWindow = 0
+	response, err = patch("0161ce38-3255-79c1-b289-e7522195b362", "orange", `{"body": "Hey."}`)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusOK))
+	}
+}
+
+// TestDeleteMessage tests that the sender can delete a message, which then goes missing from listings for both parties, and that nobody else can.
+func TestDeleteMessage(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/messages", ctrl.MessageRouter)
+	mux.HandleFunc("/message/", ctrl.MessageByIDRouter)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	reply := types.Message{From: "banana", To: "orange", Body: "Got it.", SentAt: time.Now(), ReplyTo: "0161ce38-3255-79c1-b289-e7522195b362"}
+	if err := d.SendMessage(context.Background(), &reply); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	remove := func(id string, caller string) (*http.Response, error) {
+		request, err := http.NewRequest("DELETE", ts.URL+"/message/"+id, nil)
+		if err != nil {
+			return nil, err
+		}
+		if caller != "" {
+			request.Header.Set(UserHeader, caller)
+		}
+		return http.DefaultClient.Do(request)
+	}
+	// Some bad requests first.
+	bad := []struct {
+		id     string
+		caller string
+		status int
+		detail string
+	}{
+		{"0161ce38-3255-79c1-b289-e7522195b362", "", http.StatusUnauthorized, ErrorMessage["MissingUser"]},
+		{"0161ce38-3255-79c1-b289-e7522195b362", "banana", http.StatusForbidden, ErrorMessage["NotSender"]},
+		{"0161ce38-3255-79c1-b289-e7522195b3aa", "orange", http.StatusNotFound, ErrorMessage["MessageNotFound"]},
+		{"orange", "orange", http.StatusBadRequest, ErrorMessage["BadObjectID"]},
+	}
+	for _, expected := range bad {
+		response, err := remove(expected.id, expected.caller)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s\tActual: %d - %s\tExpected: %d - %s", expected.id, expected.caller, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+	// Then the real thing.
+	response, err := remove("0161ce38-3255-79c1-b289-e7522195b362", "orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatal(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusNoContent))
+	}
+	// It's gone, and can't be deleted twice, edited, read, or replied to.
+	gone := []struct {
+		method string
+		path   string
+		caller string
+		body   string
+		detail string
+	}{
+		{"GET", "/message/0161ce38-3255-79c1-b289-e7522195b362", "", "", ErrorMessage["MessageDeleted"]},
+		{"DELETE", "/message/0161ce38-3255-79c1-b289-e7522195b362", "orange", "", ErrorMessage["MessageDeleted"]},
+		{"PATCH", "/message/0161ce38-3255-79c1-b289-e7522195b362", "orange", `{"body": "Hey."}`, ErrorMessage["MessageDeleted"]},
+		{"POST", "/message/0161ce38-3255-79c1-b289-e7522195b362/read", "banana", "", ErrorMessage["MessageDeleted"]},
+		{"GET", "/message/0161ce38-3255-79c1-b289-e7522195b362/replies", "", "", ErrorMessage["MessageDeleted"]},
+		{"POST", "/messages", "", `{"from": "banana", "to": "orange", "body": "Wait.", "replyTo": "0161ce38-3255-79c1-b289-e7522195b362"}`, ErrorMessage["ReplyToDeleted"]},
+	}
+	for _, expected := range gone {
+		request, err := http.NewRequest(expected.method, ts.URL+expected.path, strings.NewReader(expected.body))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		if expected.caller != "" {
+			request.Header.Set(UserHeader, expected.caller)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != http.StatusGone || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s\tActual: %d - %s\tExpected: %d - %s", expected.method, expected.path, response.StatusCode, problem.Detail, http.StatusGone, expected.detail))
+		}
+	}
+	// Neither party sees it in their listings, but the reply still points at it.
+	for _, query := range []string{"?to=banana", "?from=orange"} {
+		response, err := http.Get(ts.URL + "/messages" + query)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		page := types.Messages{}
+		json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if len(page.Entries) != 0 {
+			t.Error(fmt.Sprintf("%s\tActual: %v\tExpected: %v", query, page.Entries, "[]"))
+		}
+	}
+	if tombstone, err := d.GetMessage(context.Background(), "0161ce38-3255-79c1-b289-e7522195b362"); err != nil || tombstone.Body != "" || tombstone.DeletedAt == nil {
+		t.Error(fmt.Sprintf("Actual: %q - %v - %v\tExpected: %q - a deletion time - %v", tombstone.Body, tombstone.DeletedAt, err, "", nil))
+	}
+	if replies, err := d.Replies(context.Background(), []types.ID{"0161ce38-3255-79c1-b289-e7522195b362"}); err != nil || len(replies) != 1 || replies[0].ID != reply.ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: [%s] - %v", replies, err, reply.ID, nil))
+	}
+}
+
+// TestUpdateUser tests that users can change their own name and username, that the new username has to be free, and that their messages follow them.
+func TestUpdateUser(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.UserRouter))
+	defer ts.Close()
+	patch := func(id string, caller string, body string) (*http.Response, error) {
+		request, err := http.NewRequest("PATCH", ts.URL+"/users/"+id, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if caller != "" {
+			request.Header.Set(UserHeader, caller)
+		}
+		return http.DefaultClient.Do(request)
+	}
+	// Some bad requests first.
+	bad := []struct {
+		id     string
+		caller string
+		body   string
+		status int
+		detail string
+	}{
+		{"0161b891-1d85-7b4c-9133-da73a7113224", "", `{"name": "Tangerine"}`, http.StatusUnauthorized, ErrorMessage["MissingUser"]},
+		{"0161b891-1d85-7b4c-9133-da73a7113224", "banana", `{"name": "Tangerine"}`, http.StatusForbidden, ErrorMessage["NotUser"]},
+		{"0161b891-1d85-7b4c-9133-da73a7113224", "orange", `{}`, http.StatusBadRequest, ErrorMessage["EmptyPatch"]},
+		{"0161b891-1d85-7b4c-9133-da73a7113224", "orange", `{"name": ""}`, http.StatusBadRequest, ErrorMessage["BlankName"]},
+		{"0161b891-1d85-7b4c-9133-da73a7113224", "orange", `{"username": "Tangerine!"}`, http.StatusBadRequest, ErrorMessage["BadUsername"]},
+		{"0161b891-1d85-7b4c-9133-da73a7113224", "orange", `{"username": "banana"}`, http.StatusConflict, ErrorMessage["TakenUsername"]},
+		{"0161b891-1d85-7b4c-9133-da73a7113224", "orange", `name`, http.StatusBadRequest, ErrorMessage["BadJSON"]},
+		{"0161b891-1d85-7b4c-9133-da73a7113299", "orange", `{"name": "Tangerine"}`, http.StatusNotFound, ErrorMessage["UserNotFound"]},
+		{"Orange!", "orange", `{"name": "Tangerine"}`, http.StatusBadRequest, ErrorMessage["BadUserRef"]},
+		{"orange", "orange", `{"username": "a161b891-1d85-7b4c-9133-da73a7113299"}`, http.StatusBadRequest, ErrorMessage["ReservedUsername"]},
+		{"orange", "orange", `{"username": "by-username"}`, http.StatusBadRequest, ErrorMessage["ReservedUsername"]},
+	}
+	for _, expected := range bad {
+		response, err := patch(expected.id, expected.caller, expected.body)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s %s\tActual: %d - %s\tExpected: %d - %s", expected.id, expected.caller, expected.body, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+	// Then the real thing.
+	response, err := patch("0161b891-1d85-7b4c-9133-da73a7113224", "orange", `{"name": "Tangerine", "username": "tangerine"}`)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	user := types.User{}
+	json.NewDecoder(response.Body).Decode(&user)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || user.Name != "Tangerine" || user.Username != "tangerine" || user.Budget != 7 || !user.UpdatedAt.After(user.CreatedAt.Add(time.Hour)) {
+		t.Fatal(fmt.Sprintf("Actual: %d - %+v\tExpected: %d - Tangerine, tangerine, the same budget, and a new updatedAt", response.StatusCode, user, http.StatusOK))
+	}
+	if _, err := d.GetUser(context.Background(), "orange"); err != store.ErrNotFound {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	for _, id := range []types.ID{"0161b896-9746-7a0d-b2c9-5aa144c1d0ff", "0161ce38-3255-79c1-b289-e7522195b362"} {
+		if message, err := d.GetMessage(context.Background(), id); err != nil || (message.From != "tangerine" && message.To != "tangerine") {
+			t.Error(fmt.Sprintf("Actual: %s -> %s - %v\tExpected: tangerine on one end - %v", message.From, message.To, err, nil))
+		}
+	}
+}
+
+// TestDeactivateUser tests that users can deactivate their own account, after which they can't send, receive, or change anything, while their messages stay put.
+func TestDeactivateUser(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	// Creating a fake HTTP server.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", ctrl.UserRouter)
+	mux.HandleFunc("/messages", ctrl.MessageRouter)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	do := func(method string, path string, caller string, body string) (int, string) {
+		request, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		if caller != "" {
+			request.Header.Set(UserHeader, caller)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		return response.StatusCode, problem.Detail
+	}
+	steps := []struct {
+		method string
+		path   string
+		caller string
+		body   string
+		status int
+		detail string
+	}{
+		{"DELETE", "/users/0161b891-1d85-7b4c-9133-da73a7113224", "", "", http.StatusUnauthorized, ErrorMessage["MissingUser"]},
+		{"DELETE", "/users/0161b891-1d85-7b4c-9133-da73a7113224", "banana", "", http.StatusForbidden, ErrorMessage["NotUser"]},
+		{"DELETE", "/users/0161b891-1d85-7b4c-9133-da73a7113299", "orange", "", http.StatusNotFound, ErrorMessage["UserNotFound"]},
+		{"DELETE", "/users/0161b891-1d85-7b4c-9133-da73a7113224", "orange", "", http.StatusNoContent, ""},
+		{"DELETE", "/users/0161b891-1d85-7b4c-9133-da73a7113224", "orange", "", http.StatusGone, ErrorMessage["UserDeactivated"]},
+		{"PATCH", "/users/0161b891-1d85-7b4c-9133-da73a7113224", "orange", `{"name": "Tangerine"}`, http.StatusGone, ErrorMessage["UserDeactivated"]},
+		{"POST", "/messages", "", `{"from": "orange", "to": "banana", "body": "Still here?"}`, http.StatusForbidden, ErrorMessage["SenderDeactivated"]},
+		{"POST", "/messages", "", `{"from": "banana", "to": "orange", "body": "Still here?"}`, http.StatusForbidden, ErrorMessage["RecipientDeactivated"]},
+	}
+	for _, step := range steps {
+		if status, detail := do(step.method, step.path, step.caller, step.body); status != step.status || detail != step.detail {
+			t.Error(fmt.Sprintf("%s %s %s\tActual: %d - %s\tExpected: %d - %s", step.method, step.path, step.caller, status, detail, step.status, step.detail))
+		}
+	}
+	// The user and their messages are still around.
+	user, err := d.GetUser(context.Background(), "orange")
+	if err != nil || user.DeactivatedAt == nil {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: a deactivation time - %v", user.DeactivatedAt, err, nil))
+	}
+	response, err := http.Get(ts.URL + "/messages?to=banana")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	page := types.Messages{}
+	json.NewDecoder(response.Body).Decode(&page)
+	response.Body.Close()
+	if len(page.Entries) != 1 || page.Entries[0].From != "orange" {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: the message from orange", page.Entries))
+	}
+}
+
+// TestBudgetRefill tests that budgets fill back up according to the policy, whether someone looks at the user, the user sends a message, or RefillBudgets goes through everyone.
+func TestBudgetRefill(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	ctrl.Budget = budget.TokenBucket{Capacity: 7, Every: time.Hour}
+	// Creating a fake HTTP server.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", ctrl.NewUser)
+	mux.HandleFunc("/users/", ctrl.UserRouter)
+	mux.HandleFunc("/messages", ctrl.MessageRouter)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	ctx := context.Background()
+	get := func(username string) types.User {
+		response, err := http.Get(ts.URL + "/users/" + username)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		user := types.User{}
+		json.NewDecoder(response.Body).Decode(&user)
+		response.Body.Close()
+		return user
+	}
+	send := func(from string) int {
+		response, err := http.Post(ts.URL+"/messages", "application/json", strings.NewReader(`{"from": "`+from+`", "to": "banana", "body": "Hi."}`))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	// overdue makes a user's next refill an hour and a half late.
+	overdue := func(username string, budget int) {
+		user, err := d.GetUser(ctx, username)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		late := time.Now().Add(-90 * time.Minute)
+		if _, err := d.SetBudget(ctx, user, budget, &late); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	// A full bucket has no clock running, and sending a message starts it.
+	if user := get("orange"); user.Budget != 7 || user.BudgetResetsAt != nil {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", user.Budget, user.BudgetResetsAt, 7, nil))
+	}
+	if status := send("orange"); status != http.StatusCreated {
+		t.Fatal(fmt.Sprintf("Actual: %d\tExpected: %d", status, http.StatusCreated))
+	}
+	if user := get("orange"); user.Budget != 6 || user.BudgetResetsAt == nil || user.BudgetResetsAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - about an hour from now", user.Budget, user.BudgetResetsAt, 6))
+	}
+	// Looking at a user tops them up, and remembers it.
+	overdue("orange", 4)
+	if user := get("orange"); user.Budget != 6 || user.BudgetResetsAt == nil || user.BudgetResetsAt.After(time.Now().Add(30*time.Minute)) {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - about half an hour from now", user.Budget, user.BudgetResetsAt, 6))
+	}
+	if user, _ := d.GetUser(ctx, "orange"); user.Budget != 6 {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", user.Budget, 6))
+	}
+	// So does sending, before the budget gets checked.
+	overdue("orange", 0)
+	if status := send("orange"); status != http.StatusCreated {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", status, http.StatusCreated))
+	}
+	if user, _ := d.GetUser(ctx, "orange"); user.Budget != 1 {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", user.Budget, 1))
+	}
+	// Daily resets, and the background refill.
+	ctrl.Budget = budget.Daily{Limit: 3}
+	overdue("orange", 1)
+	overdue("banana", 0)
+	changed, err := ctrl.RefillBudgets(ctx)
+	if err != nil || changed != 2 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", changed, err, 2, nil))
+	}
+	midnight := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	for username, expected := range map[string]int{"orange": 3, "banana": 3} {
+		user, _ := d.GetUser(ctx, username)
+		if user.Budget != expected || user.BudgetResetsAt == nil || !user.BudgetResetsAt.Equal(midnight) {
+			t.Error(fmt.Sprintf("%s\tActual: %d - %v\tExpected: %d - %v", username, user.Budget, user.BudgetResetsAt, expected, midnight))
+		}
+	}
+	if changed, err := ctrl.RefillBudgets(ctx); err != nil || changed != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", changed, err, 0, nil))
+	}
+	// New users start out with a reset scheduled.
+	response, err := http.Post(ts.URL+"/users", "application/json", strings.NewReader(`{"name": "Cherry", "username": "cherry"}`))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	user := types.User{}
+	json.NewDecoder(response.Body).Decode(&user)
+	response.Body.Close()
+	if user.Budget != 10 || user.BudgetResetsAt == nil || !user.BudgetResetsAt.Equal(midnight) {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", user.Budget, user.BudgetResetsAt, 10, midnight))
+	}
+}
+
+// TestGetLedger tests that every budget change shows up in the ledger, refills and sends included, and that only the user can see it.
+func TestGetLedger(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	ctrl.Budget = budget.Daily{Limit: 10}
+	// Creating a fake HTTP server.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", ctrl.UserRouter)
+	mux.HandleFunc("/messages", ctrl.MessageRouter)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	response, err := http.Post(ts.URL+"/messages", "application/json", strings.NewReader(`{"from": "orange", "to": "banana", "body": "Hi."}`))
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	sent := types.Message{}
+	json.NewDecoder(response.Body).Decode(&sent)
+	response.Body.Close()
+	do := func(method string, path string, caller string) *http.Response {
+		request, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		if caller != "" {
+			request.Header.Set(UserHeader, caller)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		return response
+	}
+	// The fixtures open with 7, the daily reset tops that up to 10 before the send, and the send takes 1.
+	response = do("GET", "/users/orange/ledger", "orange")
+	entries := []types.LedgerEntry{}
+	json.NewDecoder(response.Body).Decode(&entries)
+	response.Body.Close()
+	expected := []types.LedgerEntry{
+		{Amount: 7, Balance: 7, Reason: types.ReasonOpen},
+		{Amount: 3, Balance: 10, Reason: types.ReasonRefill},
+		{Amount: -1, Balance: 9, Reason: types.ReasonSend, MessageID: sent.ID},
+	}
+	actual := []types.LedgerEntry{}
+	for _, e := range entries {
+		if e.UserID != "0161b891-1d85-7b4c-9133-da73a7113224" {
+			t.Error(fmt.Sprintf("Actual: %s\tExpected: %s", e.UserID, "0161b891-1d85-7b4c-9133-da73a7113224"))
+		}
+		actual = append(actual, types.LedgerEntry{Amount: e.Amount, Balance: e.Balance, Reason: e.Reason, MessageID: e.MessageID})
+	}
+	if response.StatusCode != http.StatusOK || fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", response.StatusCode, actual, http.StatusOK, expected))
+	}
+	if found, err := store.Reconcile(context.Background(), d); err != nil || len(found) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", found, err, "[]", nil))
+	}
+	// And now for some bad requests.
+	bad := []struct {
+		method string
+		path   string
+		caller string
+		status int
+		detail string
+	}{
+		{"GET", "/users/orange/ledger", "", http.StatusUnauthorized, ErrorMessage["MissingUser"]},
+		{"GET", "/users/orange/ledger", "banana", http.StatusForbidden, ErrorMessage["NotLedgerOwner"]},
+		{"GET", "/users/tangerine/ledger", "tangerine", http.StatusNotFound, ErrorMessage["UserNotFound"]},
+		{"GET", "/users/Orange!/ledger", "orange", http.StatusBadRequest, ErrorMessage["BadUserRef"]},
+		{"POST", "/users/orange/ledger", "orange", http.StatusMethodNotAllowed, ErrorMessage["PleaseGET"]},
+	}
+	for _, expected := range bad {
+		response := do(expected.method, expected.path, expected.caller)
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s %s\tActual: %d - %s\tExpected: %d - %s", expected.method, expected.path, expected.caller, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+}
+
+// TestGrantBudget tests that admins can give budget and take it away, that it shows up in the ledger with its reason, and that nobody else can.
+func TestGrantBudget(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	ctrl.AdminToken = "sesame"
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.UserRouter))
+	defer ts.Close()
+	do := func(method string, path string, token string, body string) *http.Response {
+		request, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		if token != "" {
+			request.Header.Set("Authorization", token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		return response
+	}
+	// The fixtures open with 7. Give 5, then take 12, down to nothing.
+	grants := []struct {
+		amount   int
+		reason   string
+		expected int
+	}{
+		{5, "Apology for the outage.", 12},
+		{-12, "Spam.", 0},
+	}
+	for _, grant := range grants {
+		response := do("POST", "/users/orange/budget", "Bearer sesame", fmt.Sprintf(`{"amount": %d, "reason": %q}`, grant.amount, grant.reason))
+		user := types.User{}
+		json.NewDecoder(response.Body).Decode(&user)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK || user.Budget != grant.expected {
+			t.Error(fmt.Sprintf("%d\tActual: %d - %d\tExpected: %d - %d", grant.amount, response.StatusCode, user.Budget, http.StatusOK, grant.expected))
+		}
+	}
+	// Admins get to see anyone's ledger, and the grants are there with their reasons.
+	response := do("GET", "/users/0161b891-1d85-7b4c-9133-da73a7113224/ledger", "bearer sesame", "")
+	entries := []types.LedgerEntry{}
+	json.NewDecoder(response.Body).Decode(&entries)
+	response.Body.Close()
+	expected := []types.LedgerEntry{
+		{Amount: 7, Balance: 7, Reason: types.ReasonOpen},
+		{Amount: 5, Balance: 12, Reason: types.ReasonGrant, Note: "Apology for the outage."},
+		{Amount: -12, Balance: 0, Reason: types.ReasonGrant, Note: "Spam."},
+	}
+	actual := []types.LedgerEntry{}
+	for _, e := range entries {
+		actual = append(actual, types.LedgerEntry{Amount: e.Amount, Balance: e.Balance, Reason: e.Reason, Note: e.Note})
+	}
+	if response.StatusCode != http.StatusOK || fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", response.StatusCode, actual, http.StatusOK, expected))
+	}
+	if found, err := store.Reconcile(context.Background(), d); err != nil || len(found) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", found, err, "[]", nil))
+	}
+	// Deactivated users are done with budgets.
+	if _, err := d.DeactivateUser(context.Background(), "0161b891-3bb7-7493-9483-64afe44d11c0", time.Now()); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	// And now for some bad requests.
+	bad := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+		detail string
+	}{
+		{"POST", "/users/orange/budget", "", `{"amount": 1, "reason": "Hi."}`, http.StatusUnauthorized, ErrorMessage["MissingToken"]},
+		{"POST", "/users/orange/budget", "Basic sesame", `{"amount": 1, "reason": "Hi."}`, http.StatusUnauthorized, ErrorMessage["MissingToken"]},
+		{"POST", "/users/orange/budget", "Bearer open", `{"amount": 1, "reason": "Hi."}`, http.StatusForbidden, ErrorMessage["BadToken"]},
+		{"POST", "/users/orange/budget", "Bearer sesame", `{"amount": 0, "reason": "Hi."}`, http.StatusBadRequest, ErrorMessage["BadAmount"]},
+		{"POST", "/users/orange/budget", "Bearer sesame", `{"amount": 1, "reason": " "}`, http.StatusBadRequest, ErrorMessage["BlankReason"]},
+		{"POST", "/users/orange/budget", "Bearer sesame", `{"amount": "1"}`, http.StatusBadRequest, ErrorMessage["BadJSON"]},
+		{"POST", "/users/orange/budget", "Bearer sesame", `{"amount": -1, "reason": "More spam."}`, http.StatusConflict, ErrorMessage["RevokeTooLarge"]},
+		{"POST", "/users/banana/budget", "Bearer sesame", `{"amount": 1, "reason": "Hi."}`, http.StatusGone, ErrorMessage["UserDeactivated"]},
+		{"POST", "/users/tangerine/budget", "Bearer sesame", `{"amount": 1, "reason": "Hi."}`, http.StatusNotFound, ErrorMessage["UserNotFound"]},
+		{"POST", "/users/Orange!/budget", "Bearer sesame", `{"amount": 1, "reason": "Hi."}`, http.StatusBadRequest, ErrorMessage["BadUserRef"]},
+		{"GET", "/users/orange/budget", "Bearer sesame", "", http.StatusMethodNotAllowed, ErrorMessage["PleasePOST"]},
+		{"GET", "/users/orange/ledger", "Bearer open", "", http.StatusForbidden, ErrorMessage["BadToken"]},
+	}
+	for _, expected := range bad {
+		response := do(expected.method, expected.path, expected.token, expected.body)
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s %s %s\tActual: %d - %s\tExpected: %d - %s", expected.method, expected.path, expected.token, expected.body, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+		if expected.status == http.StatusUnauthorized && response.Header.Get("WWW-Authenticate") == "" {
+			t.Error(fmt.Sprintf("%s %s %s\tMissing the WWW-Authenticate header", expected.method, expected.path, expected.token))
+		}
+	}
+	// Without a token configured, there are no admins at all.
+	ctrl.AdminToken = ""
+	response = do("POST", "/users/orange/budget", "Bearer ", `{"amount": 1, "reason": "Hi."}`)
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusForbidden))
+	}
+}
+
+// TestNewUserBudget tests that new users start with the configured budget, or with their plan's, and that only admins get to pick a plan.
+func TestNewUserBudget(t *testing.T) {
+	d := db.NewSession("")
+	defer d.Close()
+	ctrl := NewController(d)
+	ctrl.StartBudget = 3
+	ctrl.Plans = map[string]int{"pro": 100}
+	ctrl.AdminToken = "sesame"
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.NewUser))
+	defer ts.Close()
+	tests := []struct {
+		username string
+		plan     string
+		token    string
+		status   int
+		budget   int
+	}{
+		{"orange", "", "", http.StatusCreated, 3},
+		{"banana", "pro", "Bearer sesame", http.StatusCreated, 100},
+		{"cherry", "pro", "", http.StatusUnauthorized, 0},
+		{"cherry", "pro", "Bearer open", http.StatusForbidden, 0},
+		{"cherry", "enterprise", "Bearer sesame", http.StatusBadRequest, 0},
+		// Without the token, plans that don't exist look no different from ones that do.
+		{"cherry", "enterprise", "", http.StatusUnauthorized, 0},
+		{"cherry", "enterprise", "Bearer open", http.StatusForbidden, 0},
+	}
+	for _, test := range tests {
+		request, err := http.NewRequest("POST", ts.URL, strings.NewReader(fmt.Sprintf(`{"name": "Fruit", "username": %q, "plan": %q}`, test.username, test.plan)))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		if test.token != "" {
+			request.Header.Set("Authorization", test.token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		user := types.User{}
+		json.NewDecoder(response.Body).Decode(&user)
+		response.Body.Close()
+		if response.StatusCode != test.status || user.Budget != test.budget || (test.status == http.StatusCreated && user.Plan != test.plan) {
+			t.Error(fmt.Sprintf("%s %s\tActual: %d - %d - %s\tExpected: %d - %d - %s", test.username, test.plan, response.StatusCode, user.Budget, user.Plan, test.status, test.budget, test.plan))
+		}
+	}
+}
+
+// TestMessagePricing tests that messages cost what the rates say, both when quoted and when sent, that senders are charged that much, and that edits can't make a message cost more than was paid.
+func TestMessagePricing(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	ctrl.Pricing = pricing.Rates{Base: 1, Length: 10, High: 2}
+	// Creating a fake HTTP server.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/messages", ctrl.MessageRouter)
+	mux.HandleFunc("/messages/quote", ctrl.QuoteMessage)
+	mux.HandleFunc("/message/", ctrl.MessageByIDRouter)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	do := func(method string, path string, body string) *http.Response {
+		request, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		request.Header.Set(UserHeader, "orange")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		return response
+	}
+	// 25 characters is two more lots of 10 on top of the base, and high priority is 2 more on top of that.
+	message := `{"from": "orange", "to": "banana", "body": "` + strings.Repeat("a", 25) + `", "priority": "high"}`
+	response := do("POST", "/messages/quote", message)
+	quote := types.Quote{}
+	json.NewDecoder(response.Body).Decode(&quote)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || quote.Cost != 5 {
+		t.Error(fmt.Sprintf("Actual: %d - %d\tExpected: %d - %d", response.StatusCode, quote.Cost, http.StatusOK, 5))
+	}
+	// Quotes don't charge anyone.
+	if orange, _ := d.GetUser(context.Background(), "orange"); orange.Budget != 7 {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", orange.Budget, 7))
+	}
+	response = do("POST", "/messages", message)
+	sent := types.Message{}
+	json.NewDecoder(response.Body).Decode(&sent)
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated || sent.Cost != 5 || sent.Priority != types.PriorityHigh {
+		t.Error(fmt.Sprintf("Actual: %d - %d - %s\tExpected: %d - %d - %s", response.StatusCode, sent.Cost, sent.Priority, http.StatusCreated, 5, types.PriorityHigh))
+	}
+	orange, _ := d.GetUser(context.Background(), "orange")
+	entries, _ := d.Ledger(context.Background(), orange.ID)
+	if orange.Budget != 2 || len(entries) != 2 || entries[1].Amount != -5 || entries[1].MessageID != sent.ID {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - a send for %d", orange.Budget, entries, 2, -5))
+	}
+	// And now for some bad requests.
+	bad := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		detail string
+	}{
+		{"POST", "/messages", message, http.StatusForbidden, fmt.Sprintf(ErrorMessage["CantAfford"], 5, 2)},
+		{"PATCH", "/message/" + string(sent.ID), `{"body": "` + strings.Repeat("a", 31) + `"}`, http.StatusForbidden, ErrorMessage["EditCostsMore"]},
+		{"POST", "/messages/quote", `{"from": "orange", "to": "banana", "body": "Hi.", "priority": "urgent"}`, http.StatusBadRequest, ErrorMessage["BadPriority"]},
+		{"POST", "/messages/quote", `{"from": "orange", "to": "banana", "body": ""}`, http.StatusBadRequest, ErrorMessage["EmptyBody"]},
+		{"POST", "/messages/quote", `{"from": "orange"`, http.StatusBadRequest, ErrorMessage["BadJSON"]},
+		{"GET", "/messages/quote", "", http.StatusMethodNotAllowed, ErrorMessage["PleasePOST"]},
+	}
+	for _, expected := range bad {
+		response := do(expected.method, expected.path, expected.body)
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != expected.status || problem.Detail != expected.detail {
+			t.Error(fmt.Sprintf("%s %s %s\tActual: %d - %s\tExpected: %d - %s", expected.method, expected.path, expected.body, response.StatusCode, problem.Detail, expected.status, expected.detail))
+		}
+	}
+	// Edits that cost the same or less are fine.
+	response = do("PATCH", "/message/"+string(sent.ID), `{"body": "`+strings.Repeat("a", 30)+`"}`)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", response.StatusCode, http.StatusOK))
+	}
+	// Once rates go up, both the message and the edit go by the new ones, so edits that don't change the price are still fine, and ones that do still aren't.
+	ctrl.Pricing = pricing.Rates{Base: 3, Length: 10, High: 4}
+	for body, expected := range map[string]int{strings.Repeat("b", 30): http.StatusOK, strings.Repeat("b", 31): http.StatusForbidden} {
+		response = do("PATCH", "/message/"+string(sent.ID), `{"body": "`+body+`"}`)
+		response.Body.Close()
+		if response.StatusCode != expected {
+			t.Error(fmt.Sprintf("%d characters\tActual: %d\tExpected: %d", len(body), response.StatusCode, expected))
+		}
+	}
+}
+
+// TestNewMessageCantAfford tests that senders with some budget left, but not enough for the message, are told what it costs and what they have, rather than that they have nothing.
+func TestNewMessageCantAfford(t *testing.T) {
+	d := db.NewFakeSession()
+	defer d.Close()
+	ctrl := NewController(d)
+	ctrl.Pricing = pricing.Rates{Base: 2}
+	// Creating a fake HTTP server.
+	ts := httptest.NewServer(http.HandlerFunc(ctrl.MessageRouter))
+	defer ts.Close()
+	orange, err := d.GetUser(context.Background(), "orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	for _, test := range []struct {
+		budget int
+		detail string
+	}{
+		{1, fmt.Sprintf(ErrorMessage["CantAfford"], 2, 1)},
+		{0, ErrorMessage["BudgetExceeded"]},
+	} {
+		if orange, err = d.SetBudget(context.Background(), orange, test.budget, nil); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		response, err := http.Post(ts.URL, "application/json", strings.NewReader(`{"from": "orange", "to": "banana", "body": "Hi."}`))
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		problem := types.Problem{}
+		json.NewDecoder(response.Body).Decode(&problem)
+		response.Body.Close()
+		if response.StatusCode != http.StatusForbidden || problem.Detail != test.detail {
+			t.Error(fmt.Sprintf("%d\tActual: %d - %s\tExpected: %d - %s", test.budget, response.StatusCode, problem.Detail, http.StatusForbidden, test.detail))
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package ctrl
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 
+	"github.com/ellenkorbes/chatty/store"
 	"github.com/ellenkorbes/chatty/types"
 )
 
@@ -21,25 +24,67 @@ func Error(response http.ResponseWriter, request *http.Request, status int, deta
 	})
 }
 
+// DBError returns the Problem JSON object fitting an error returned by the storage layer. The notFound argument is the ErrorMessage key to use when the record doesn't exist, and unexpected is the detail for anything we didn't see coming.
+func DBError(response http.ResponseWriter, request *http.Request, err error, notFound string, unexpected string) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		Error(response, request, http.StatusGatewayTimeout, ErrorMessage["Timeout"])
+	case errors.Is(err, context.Canceled):
+		Error(response, request, http.StatusServiceUnavailable, ErrorMessage["Canceled"])
+	case errors.Is(err, store.ErrNotFound):
+		Error(response, request, http.StatusNotFound, ErrorMessage[notFound])
+	case errors.Is(err, store.ErrDuplicate):
+		Error(response, request, http.StatusConflict, ErrorMessage["TakenUsername"])
+	case errors.Is(err, store.ErrBudgetExhausted):
+		Error(response, request, http.StatusForbidden, ErrorMessage["BudgetExceeded"])
+	case errors.Is(err, store.ErrConflict):
+		Error(response, request, http.StatusConflict, ErrorMessage["Conflict"])
+	default:
+		Error(response, request, http.StatusInternalServerError, unexpected)
+	}
+}
+
 // ErrorMessage is a central location to store all error messages in the system.
 var ErrorMessage map[interface{}]string = map[interface{}]string{
 	// These go on Problem.Title:
 	201: "Created",
 	400: "Bad Request",
+	401: "Unauthorized",
 	403: "Forbidden",
 	404: "Not Found",
 	405: "Method Not Allowed",
 	409: "Conflict",
+	410: "Gone",
 	500: "Internal Server Error",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
 	// These go on Problem.Detail:
 	"PleasePOST":           "Please use a POST request for this endpoint.",
 	"PleaseGET":            "Please use a GET request for this endpoint.",
+	"PleasePATCH":          "Please use a PATCH request for this endpoint.",
+	"PleaseDELETE":         "Please use a DELETE request for this endpoint.",
 	"db.GetUser":           "Unknown error in db.GetUser call.",
-	"db.GetAll":            "Unknown error in db.GetAll call.",
-	"db.GetMessagesByUser": "Unknown error in db.GetMessagesByUser call.",
+	"db.ListUsers":         "Unknown error in db.ListUsers call.",
+	"db.ListMessages":      "Unknown error in db.ListMessages call.",
+	"db.FindMessages":      "Unknown error in db.FindMessages call.",
+	"db.Conversations":     "Unknown error in db.Conversations call.",
+	"db.Replies":           "Unknown error in db.Replies call.",
+	"db.DeliverMessages":   "Unknown error in db.DeliverMessages call.",
+	"db.ReadMessage":       "Unknown error in db.ReadMessage call.",
+	"db.ReadMessages":      "Unknown error in db.ReadMessages call.",
+	"db.CountUnread":       "Unknown error in db.CountUnread call.",
+	"db.EditMessage":       "Unknown error in db.EditMessage call.",
+	"db.DeleteMessage":     "Unknown error in db.DeleteMessage call.",
+	"db.UpdateUser":        "Unknown error in db.UpdateUser call.",
+	"db.DeactivateUser":    "Unknown error in db.DeactivateUser call.",
+	"db.SetBudget":         "Unknown error in db.SetBudget call.",
+	"db.Ledger":            "Unknown error in db.Ledger call.",
+	"db.GrantBudget":       "Unknown error in db.GrantBudget call.",
 	"db.IsUnique":          "Unknown error in db.IsUnique call.",
-	"db.Add":               "Unknown error in db.Add call.",
-	"db.Get":               "Unknown error in db.Get call.",
+	"db.AddUser":           "Unknown error in db.AddUser call.",
+	"db.GetUserByID":       "Unknown error in db.GetUserByID call.",
+	"db.GetMessage":        "Unknown error in db.GetMessage call.",
+	"db.SendMessage":       "Unknown error in db.SendMessage call.",
 	"BadJSON":              "Error parsing JSON object.",
 	"BadUsername":          "The username should only contain lowercase alphanumerical characters, dashes, and underscores.",
 	"BlankUsername":        "The username value cannot be blank.",
@@ -47,14 +92,55 @@ var ErrorMessage map[interface{}]string = map[interface{}]string{
 	"UserNotFound":         "Username not found.",
 	"MessageNotFound":      "Message not found.",
 	"BadObjectID":          "The supplied object ID is invalid.",
+	"BadUserRef":           "The supplied user should be either a user ID or a username.",
+	"ReservedUsername":     "The username can't look like a user ID, or be by-username.",
+	"NoSuchPath":           "There's nothing at this path.",
 	"SenderNotFound":       "Sender username not found.",
 	"UnexpectedSender":     "Unknown error verifying sender.",
+	"BadReplyTo":           "The replyTo field should be a message ID.",
+	"ReplyToNotFound":      "The message being replied to doesn't exist.",
+	"ReplyToForbidden":     "Senders can only reply to messages they've sent or received.",
 	"BudgetExceeded":       "The sender username has no budget left.",
+	"CantAfford":           "The sender can't afford this message: it costs %d, and they have %d left.",
 	"RecipientNotFound":    "Recipient username not found.",
 	"UnexpectedRecipient":  "Unknown error verifying recipient.",
 	"EmptyTo":              "The message sender is empty. ",
 	"EmptyFrom":            "The message recipient is empty. ",
 	"EmptyBody":            "The message has no content.",
 	"LengthExceeded":       "Message maximum length exceeded: it can contain no more than 280 characters.",
+	"Conflict":             "The record was changed by someone else. Please try again.",
+	"Timeout":              "The database took too long to answer.",
+	"Canceled":             "The request was cancelled before the database could answer.",
+	"BadLimit":             "The limit should be a whole number from 1 to 100.",
+	"BadCursor":            "The cursor is invalid. Please use the next cursor from a previous page.",
+	"BadSince":             "The since parameter should be a date and time in RFC 3339 format.",
+	"BadUntil":             "The until parameter should be a date and time in RFC 3339 format.",
+	"BadTimeRange":         "The since parameter should come before the until parameter.",
+	"BadOrder":             "The order parameter should be either asc or desc.",
+	"EmptyToFrom":          "Please give a recipient, a sender, or both.",
+	"BadUnread":            "The unread parameter should be either true or false.",
+	"MissingUser":          "Please say who you are in the X-Chatty-User header.",
+	"NotRecipient":         "Only the recipient can mark messages as read.",
+	"BadUpTo":              "The upTo field should be the ID of a message sent to this user.",
+	"MessageDeleted":       "This message has been deleted.",
+	"ReplyToDeleted":       "The message being replied to has been deleted.",
+	"NotSender":            "Only the sender can edit or delete a message.",
+	"EditWindowPassed":     "This message was sent too long ago to be edited.",
+	"EmptyPatch":           "Please give a new name, username, or both.",
+	"BlankName":            "The name value cannot be blank.",
+	"NotUser":              "Users can only change their own account.",
+	"NotLedgerOwner":       "Users can only see their own ledger.",
+	"UserDeactivated":      "This user has been deactivated.",
+	"SenderDeactivated":    "The sender has been deactivated.",
+	"RecipientDeactivated": "The recipient has been deactivated.",
+	"AdminDisabled":        "Admin requests are turned off on this server.",
+	"MissingToken":         "Please give the admin token in the Authorization header, as in Bearer {token}.",
+	"BadToken":             "The admin token is wrong.",
+	"UnknownPlan":          "There's no such plan.",
+	"BadAmount":            "The amount should be a whole number other than zero.",
+	"BlankReason":          "Please say what the change is for in the reason field.",
+	"RevokeTooLarge":       "The user doesn't have that much budget to take away.",
+	"BadPriority":          "The priority should be either normal or high.",
+	"EditCostsMore":        "The edited message would cost more than it does as it is. Please send a new one instead.",
 	"BlankMessage":         "",
 }
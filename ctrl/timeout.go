@@ -0,0 +1,158 @@
+package ctrl
+
+import (
+	"context"
+	"time"
+
+	"github.com/ellenkorbes/chatty/store"
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// timeoutDB gives every call to the database it wraps a deadline of its own, timeout from when the call starts, on top of whatever the caller's context already has. A request that makes several calls gets the full timeout for each of them.
+type timeoutDB struct {
+	db      DBInterface
+	timeout time.Duration
+}
+
+// Making sure we keep up with the interface.
+var _ DBInterface = timeoutDB{}
+
+// db returns the database the handlers talk to: c.DB, with c.Timeout on every call. Zero means no limit other than the client's patience, so it's c.DB as it is.
+func (c *Controller) db() DBInterface {
+	if c.Timeout <= 0 {
+		return c.DB
+	}
+	return timeoutDB{c.DB, c.Timeout}
+}
+
+func (t timeoutDB) AddUser(ctx context.Context, user *types.User) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.AddUser(ctx, user)
+}
+
+func (t timeoutDB) GetUserByID(ctx context.Context, id types.ID) (types.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.GetUserByID(ctx, id)
+}
+
+func (t timeoutDB) GetUser(ctx context.Context, username string) (types.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.GetUser(ctx, username)
+}
+
+func (t timeoutDB) ListUsers(ctx context.Context) ([]types.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.ListUsers(ctx)
+}
+
+func (t timeoutDB) IsUnique(ctx context.Context, user types.User) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.IsUnique(ctx, user)
+}
+
+func (t timeoutDB) UpdateUser(ctx context.Context, id types.ID, name string, username string, at time.Time) (types.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.UpdateUser(ctx, id, name, username, at)
+}
+
+func (t timeoutDB) DeactivateUser(ctx context.Context, id types.ID, at time.Time) (types.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.DeactivateUser(ctx, id, at)
+}
+
+func (t timeoutDB) SetBudget(ctx context.Context, old types.User, budget int, resetsAt *time.Time) (types.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.SetBudget(ctx, old, budget, resetsAt)
+}
+
+func (t timeoutDB) GrantBudget(ctx context.Context, id types.ID, amount int, note string, at time.Time) (types.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.GrantBudget(ctx, id, amount, note, at)
+}
+
+func (t timeoutDB) Ledger(ctx context.Context, id types.ID) ([]types.LedgerEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.Ledger(ctx, id)
+}
+
+func (t timeoutDB) SendMessage(ctx context.Context, message *types.Message) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.SendMessage(ctx, message)
+}
+
+func (t timeoutDB) GetMessage(ctx context.Context, id types.ID) (types.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.GetMessage(ctx, id)
+}
+
+func (t timeoutDB) ListMessages(ctx context.Context) ([]types.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.ListMessages(ctx)
+}
+
+func (t timeoutDB) FindMessages(ctx context.Context, q store.MessageQuery) (types.Messages, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.FindMessages(ctx, q)
+}
+
+func (t timeoutDB) Conversations(ctx context.Context, username string) ([]types.Conversation, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.Conversations(ctx, username)
+}
+
+func (t timeoutDB) Replies(ctx context.Context, ids []types.ID) ([]types.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.Replies(ctx, ids)
+}
+
+func (t timeoutDB) DeliverMessages(ctx context.Context, ids []types.ID, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.DeliverMessages(ctx, ids, at)
+}
+
+func (t timeoutDB) ReadMessage(ctx context.Context, id types.ID, at time.Time) (types.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.ReadMessage(ctx, id, at)
+}
+
+func (t timeoutDB) ReadMessages(ctx context.Context, q store.MessageQuery, at time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.ReadMessages(ctx, q, at)
+}
+
+func (t timeoutDB) CountUnread(ctx context.Context, username string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.CountUnread(ctx, username)
+}
+
+func (t timeoutDB) EditMessage(ctx context.Context, id types.ID, body string, at time.Time) (types.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.EditMessage(ctx, id, body, at)
+}
+
+func (t timeoutDB) DeleteMessage(ctx context.Context, id types.ID, at time.Time) (types.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.db.DeleteMessage(ctx, id, at)
+}
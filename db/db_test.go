@@ -0,0 +1,542 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ellenkorbes/chatty/migrate"
+	"github.com/ellenkorbes/chatty/store"
+	"github.com/ellenkorbes/chatty/types"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// testSession connects to the MongoDB instance in the CHATTY_TEST_MONGO environment variable, or skips the test if there isn't one. Every call gets its own throwaway database, which is dropped once the test is over, so tests never see each other's data or anyone else's.
+func testSession(t *testing.T) DBObject {
+	url := os.Getenv("CHATTY_TEST_MONGO")
+	if url == "" {
+		t.Skip("Set CHATTY_TEST_MONGO to a MongoDB URL to run this test.")
+	}
+	names := DefaultNames
+	names.Database = "chatty_test_" + strings.Replace(string(types.NewID()), "-", "", -1)
+	d, err := NewSession(Options{URL: url, ConnectTimeout: 5 * time.Second, Names: names})
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	t.Cleanup(func() {
+		d.Client.Database(names.Database).Drop(context.Background())
+		d.Close()
+	})
+	if err := d.Bootstrap(context.Background()); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	return d
+}
+
+// TestUsers tests storing and fetching users, and that usernames can't be found where they don't exist.
+func TestUsers(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	user := types.User{Name: "Orange", Username: "orange", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &user); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	byID, err := d.GetUserByID(ctx, user.ID)
+	if err != nil || byID.Username != user.Username {
+		t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", byID.Username, err, user.Username, nil))
+	}
+	byName, err := d.GetUser(ctx, "orange")
+	if err != nil || byName.ID != user.ID {
+		t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", byName.ID, err, user.ID, nil))
+	}
+	if _, err := d.GetUser(ctx, "banana"); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	unique, err := d.IsUnique(ctx, user)
+	if err != nil || unique {
+		t.Error(fmt.Sprintf("Actual: %t - %v\tExpected: %t - %v", unique, err, false, nil))
+	}
+	// The unique index has the last word, whatever IsUnique says.
+	twin := types.User{Name: "Other Orange", Username: "orange", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &twin); !errors.Is(err, store.ErrDuplicate) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrDuplicate))
+	}
+}
+
+// TestSendMessage tests that sending charges the sender, and that broke or imaginary senders can't send.
+func TestSendMessage(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now(), Cost: 1}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	inbox, err := d.FindMessages(ctx, store.MessageQuery{To: "banana"})
+	if err != nil || len(inbox.Entries) != 1 || inbox.Entries[0].ID != message.ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: [%s] - %v", inbox.Entries, err, message.ID, nil))
+	}
+	again := types.Message{From: "orange", To: "banana", Body: "Hi again.", SentAt: time.Now(), Cost: 1}
+	if err := d.SendMessage(ctx, &again); !errors.Is(err, store.ErrBudgetExhausted) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrBudgetExhausted))
+	}
+	ghost := types.Message{From: "apple", To: "banana", Body: "Boo.", SentAt: time.Now()}
+	if err := d.SendMessage(ctx, &ghost); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestFindMessages tests that a query with a limit pages through an inbox in order, with a cursor on every page but the last, and that filters and order work from the outbox side too.
+func TestFindMessages(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 5, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	sentAt := time.Now()
+	sent := []types.ID{}
+	for i := 0; i < 5; i++ {
+		message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: sentAt}
+		if err := d.SendMessage(ctx, &message); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		sent = append(sent, message.ID)
+	}
+	got := []types.ID{}
+	q := store.MessageQuery{To: "banana", Limit: 2}
+	for pages := 1; ; pages++ {
+		page, err := d.FindMessages(ctx, q)
+		if err != nil || pages > 3 {
+			t.Fatal(fmt.Sprintf("Actual: page %d - %v\tExpected: at most page %d - %v", pages, err, 3, nil))
+		}
+		for _, m := range page.Entries {
+			got = append(got, m.ID)
+		}
+		if page.Next == "" {
+			break
+		}
+		after, err := store.ParseCursor(page.Next)
+		if err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		q.After = &after
+	}
+	if fmt.Sprint(got) != fmt.Sprint(sent) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", got, sent))
+	}
+	// Newest first, from the sender's side, within a time range that takes them all.
+	q = store.MessageQuery{From: "orange", Since: sentAt.Add(-time.Second), Until: sentAt.Add(time.Second), Descending: true, Limit: 2}
+	q.After = &store.Cursor{SentAt: sentAt.Truncate(time.Millisecond), ID: sent[4]}
+	page, err := d.FindMessages(ctx, q)
+	if err != nil || len(page.Entries) != 2 || page.Entries[0].ID != sent[3] || page.Entries[1].ID != sent[2] || page.Next == "" {
+		t.Error(fmt.Sprintf("Actual: %v - %q - %v\tExpected: [%s %s] - a cursor - %v", page.Entries, page.Next, err, sent[3], sent[2], nil))
+	}
+}
+
+// TestConversations tests that conversations are grouped by the other user, most recent first, and that only unread messages to the user count as unread.
+func TestConversations(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"apple", "banana", "orange"} {
+		user := types.User{Name: username, Username: username, Budget: 5, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	read := time.Now()
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	sent := []types.Message{
+		{From: "banana", To: "orange", Body: "Hi.", SentAt: start},
+		{From: "orange", To: "banana", Body: "Hi!", SentAt: start.Add(time.Second)},
+		{From: "apple", To: "orange", Body: "Psst.", SentAt: start.Add(2 * time.Second), ReadAt: &read},
+		{From: "banana", To: "orange", Body: "You there?", SentAt: start.Add(3 * time.Second)},
+		{From: "banana", To: "apple", Body: "Not you.", SentAt: start.Add(4 * time.Second)},
+	}
+	for i := range sent {
+		if err := d.SendMessage(ctx, &sent[i]); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	conversations, err := d.Conversations(ctx, "orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	expected := []types.Conversation{
+		{With: "banana", Last: sent[3], Unread: 2},
+		{With: "apple", Last: sent[2], Unread: 0},
+	}
+	if len(conversations) != len(expected) {
+		t.Fatal(fmt.Sprintf("Actual: %v\tExpected: %v", conversations, expected))
+	}
+	for i, c := range conversations {
+		if c.With != expected[i].With || c.Last.ID != expected[i].Last.ID || c.Unread != expected[i].Unread {
+			t.Error(fmt.Sprintf("Actual: %s - %s - %d\tExpected: %s - %s - %d", c.With, c.Last.ID, c.Unread, expected[i].With, expected[i].Last.ID, expected[i].Unread))
+		}
+	}
+}
+
+// TestReadMessages tests that marking messages as read goes up to the message given and no further, and leaves earlier read receipts alone.
+func TestReadMessages(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	sent := []types.Message{}
+	for i := 0; i < 5; i++ {
+		message := types.Message{From: "orange", To: "banana", Body: fmt.Sprint("Message ", i), SentAt: start.Add(time.Duration(i) * time.Second)}
+		if err := d.SendMessage(ctx, &message); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		sent = append(sent, message)
+	}
+	if count, err := d.CountUnread(ctx, "banana"); err != nil || count != 5 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 5, nil))
+	}
+	first := start.Add(time.Hour)
+	message, err := d.ReadMessage(ctx, sent[1].ID, first)
+	if err != nil || message.ReadAt == nil || !message.ReadAt.Equal(first) || message.DeliveredAt == nil {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", message.ReadAt, err, first, nil))
+	}
+	through := store.CursorOf(sent[2])
+	later := start.Add(2 * time.Hour)
+	if count, err := d.ReadMessages(ctx, store.MessageQuery{To: "banana", Through: &through}, later); err != nil || count != 2 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 2, nil))
+	}
+	if count, err := d.CountUnread(ctx, "banana"); err != nil || count != 2 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 2, nil))
+	}
+	if message, _ := d.GetMessage(ctx, sent[1].ID); message.ReadAt == nil || !message.ReadAt.Equal(first) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", message.ReadAt, first))
+	}
+	unread, err := d.FindMessages(ctx, store.MessageQuery{To: "banana", Unread: true})
+	if err != nil || len(unread.Entries) != 2 || unread.Entries[0].ID != sent[3].ID || unread.Entries[1].ID != sent[4].ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: [%s %s] - %v", unread.Entries, err, sent[3].ID, sent[4].ID, nil))
+	}
+	if _, err := d.ReadMessage(ctx, types.NewID(), later); err != store.ErrNotFound {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestEditMessage tests that edits keep every earlier body, each with when it was written, and that deleted messages can't be edited.
+func TestEditMessage(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: start}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	for i, body := range []string{"Hello.", "Hello there."} {
+		if _, err := d.EditMessage(ctx, message.ID, body, start.Add(time.Duration(i+1)*time.Minute)); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	edited, err := d.GetMessage(ctx, message.ID)
+	expected := []types.Revision{{Body: "Hi.", WrittenAt: start}, {Body: "Hello.", WrittenAt: start.Add(time.Minute)}}
+	if err != nil || edited.Body != "Hello there." || edited.EditedAt == nil || !edited.EditedAt.Equal(start.Add(2*time.Minute)) || fmt.Sprint(edited.Revisions) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Actual: %q - %v - %v - %v\tExpected: %q - %v - %v - %v", edited.Body, edited.EditedAt, edited.Revisions, err, "Hello there.", start.Add(2*time.Minute), expected, nil))
+	}
+	if _, err := d.DeleteMessage(ctx, message.ID, start.Add(time.Hour)); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.EditMessage(ctx, message.ID, "Too late.", start.Add(2*time.Hour)); err != store.ErrConflict {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	if _, err := d.EditMessage(ctx, types.NewID(), "Nobody.", start); err != store.ErrNotFound {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestDeleteMessage tests that a deleted message leaves a tombstone behind, which stays out of every listing and count but keeps its replies.
+func TestDeleteMessage(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	message := types.Message{From: "orange", To: "banana", Body: "Oops.", SentAt: start}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	reply := types.Message{From: "banana", To: "orange", Body: "What?", SentAt: start.Add(time.Second), ReplyTo: message.ID}
+	if err := d.SendMessage(ctx, &reply); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.EditMessage(ctx, message.ID, "Oops!", start.Add(time.Minute)); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	tombstone, err := d.DeleteMessage(ctx, message.ID, start.Add(time.Hour))
+	if err != nil || tombstone.Body != "" || tombstone.Revisions != nil || tombstone.EditedAt != nil || tombstone.DeletedAt == nil {
+		t.Error(fmt.Sprintf("Actual: %+v - %v\tExpected: a tombstone - %v", tombstone, err, nil))
+	}
+	if _, err := d.DeleteMessage(ctx, message.ID, start.Add(2*time.Hour)); err != store.ErrConflict {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	for _, q := range []store.MessageQuery{{To: "banana"}, {From: "orange"}, {To: "banana", Unread: true}, {To: "banana", From: "orange", EitherWay: true}, {}} {
+		messages, err := d.FindMessages(ctx, q)
+		for _, m := range messages.Entries {
+			if m.ID == message.ID || err != nil {
+				t.Error(fmt.Sprintf("%+v\tActual: %v - %v\tExpected: no tombstone - %v", q, messages.Entries, err, nil))
+			}
+		}
+	}
+	if count, err := d.CountUnread(ctx, "banana"); err != nil || count != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", count, err, 0, nil))
+	}
+	if conversations, err := d.Conversations(ctx, "banana"); err != nil || len(conversations) != 1 || conversations[0].Last.ID != reply.ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: the reply as the last message - %v", conversations, err, nil))
+	}
+	if replies, err := d.Replies(ctx, []types.ID{message.ID}); err != nil || len(replies) != 1 || replies[0].ID != reply.ID {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: [%s] - %v", replies, err, reply.ID, nil))
+	}
+}
+
+// TestUpdateUser tests that a new username carries over to every message, listings and unread counts included, that taken usernames stay taken, and that deactivated users can't be changed.
+func TestUpdateUser(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	users := map[string]types.User{}
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 10, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		users[username] = user
+	}
+	start := time.Date(2018, 2, 21, 13, 0, 0, 0, time.UTC)
+	sent := []types.Message{
+		{From: "orange", To: "banana", Body: "Hi.", SentAt: start, Cost: 1},
+		{From: "banana", To: "orange", Body: "Hi!", SentAt: start.Add(time.Second), Cost: 1},
+		{From: "orange", To: "orange", Body: "Note to self.", SentAt: start.Add(2 * time.Second), Cost: 1},
+		{From: "banana", To: "orange", Body: "Oops.", SentAt: start.Add(3 * time.Second), Cost: 1},
+	}
+	for i := range sent {
+		if err := d.SendMessage(ctx, &sent[i]); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+	}
+	if _, err := d.DeleteMessage(ctx, sent[3].ID, start.Add(time.Minute)); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.UpdateUser(ctx, users["orange"].ID, "Orange", "banana", start); err != store.ErrDuplicate {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrDuplicate))
+	}
+	user, err := d.UpdateUser(ctx, users["orange"].ID, "Tangerine", "tangerine", start.Add(time.Hour))
+	if err != nil || user.Name != "Tangerine" || user.Username != "tangerine" || !user.UpdatedAt.Equal(start.Add(time.Hour)) || user.Budget != 8 {
+		t.Fatal(fmt.Sprintf("Actual: %+v - %v\tExpected: Tangerine, tangerine, a new updatedAt, and the same budget - %v", user, err, nil))
+	}
+	if _, err := d.GetUser(ctx, "orange"); err != store.ErrNotFound {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	expected := map[string]int{"to tangerine": 2, "from tangerine": 2, "to orange": 0, "from orange": 0, "unread tangerine": 2}
+	actual := map[string]int{}
+	for _, username := range []string{"tangerine", "orange"} {
+		for name, q := range map[string]store.MessageQuery{"to ": {To: username}, "from ": {From: username}} {
+			messages, err := d.FindMessages(ctx, q)
+			if err != nil {
+				t.Fatal(fmt.Sprintln("Unknown error:", err))
+			}
+			actual[name+username] = len(messages.Entries)
+		}
+	}
+	if actual["unread tangerine"], err = d.CountUnread(ctx, "tangerine"); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", actual, expected))
+	}
+	if tombstone, err := d.GetMessage(ctx, sent[3].ID); err != nil || tombstone.To != "tangerine" {
+		t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", tombstone.To, err, "tangerine", nil))
+	}
+	// The old username is free again.
+	if unique, err := d.IsUnique(ctx, types.User{Username: "orange"}); err != nil || !unique {
+		t.Error(fmt.Sprintf("Actual: %t - %v\tExpected: %t - %v", unique, err, true, nil))
+	}
+	user, err = d.DeactivateUser(ctx, users["banana"].ID, start.Add(2*time.Hour))
+	if err != nil || user.DeactivatedAt == nil || !user.DeactivatedAt.Equal(start.Add(2*time.Hour)) {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", user.DeactivatedAt, err, start.Add(2*time.Hour), nil))
+	}
+	if _, err := d.DeactivateUser(ctx, users["banana"].ID, start.Add(3*time.Hour)); err != store.ErrConflict {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	if _, err := d.UpdateUser(ctx, users["banana"].ID, "Plantain", "plantain", start.Add(3*time.Hour)); err != store.ErrConflict {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+}
+
+// TestSetBudget tests that budgets only change while they're still what the caller last saw, and that reset times survive the trip to the database.
+func TestSetBudget(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	user := types.User{Name: "Orange", Username: "orange", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &user); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	resets := time.Date(2018, 2, 22, 0, 0, 0, 0, time.UTC)
+	updated, err := d.SetBudget(ctx, user, 10, &resets)
+	if err != nil || updated.Budget != 10 || updated.BudgetResetsAt == nil || !updated.BudgetResetsAt.Equal(resets) {
+		t.Fatal(fmt.Sprintf("Actual: %d - %v - %v\tExpected: %d - %v - %v", updated.Budget, updated.BudgetResetsAt, err, 10, resets, nil))
+	}
+	// The old user is out of date now.
+	if _, err := d.SetBudget(ctx, user, 5, nil); !errors.Is(err, store.ErrConflict) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	stored, err := d.GetUserByID(ctx, user.ID)
+	if err != nil || stored.Budget != 10 || stored.BudgetResetsAt == nil || !stored.BudgetResetsAt.Equal(resets) {
+		t.Fatal(fmt.Sprintf("Actual: %d - %v - %v\tExpected: %d - %v - %v", stored.Budget, stored.BudgetResetsAt, err, 10, resets, nil))
+	}
+	// The stored one isn't, and no reset time is fine too.
+	if updated, err := d.SetBudget(ctx, stored, 5, nil); err != nil || updated.Budget != 5 || updated.BudgetResetsAt != nil {
+		t.Error(fmt.Sprintf("Actual: %d - %v - %v\tExpected: %d - %v - %v", updated.Budget, updated.BudgetResetsAt, err, 5, nil, nil))
+	}
+	if _, err := d.SetBudget(ctx, types.User{ID: types.NewID()}, 5, nil); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestLedger tests that opening, sending, and refilling each leave an entry in the ledger, so that it adds up to the budget.
+func TestLedger(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	users := map[string]types.User{}
+	for _, username := range []string{"orange", "banana"} {
+		user := types.User{Name: username, Username: username, Budget: 2, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := d.AddUser(ctx, &user); err != nil {
+			t.Fatal(fmt.Sprintln("Unknown error:", err))
+		}
+		users[username] = user
+	}
+	message := types.Message{From: "orange", To: "banana", Body: "Hi.", SentAt: time.Now(), Cost: 1}
+	if err := d.SendMessage(ctx, &message); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	orange, err := d.GetUserByID(ctx, users["orange"].ID)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.SetBudget(ctx, orange, 5, nil); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	entries, err := d.Ledger(ctx, users["orange"].ID)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	expected := "[open 2 2 ] [send -1 1 " + string(message.ID) + "] [refill 4 5 ]"
+	actual := ""
+	for _, e := range entries {
+		actual += fmt.Sprintf(" [%s %d %d %s]", e.Reason, e.Amount, e.Balance, e.MessageID)
+	}
+	if strings.TrimSpace(actual) != expected {
+		t.Error(fmt.Sprintf("Actual: %s\tExpected: %s", actual, expected))
+	}
+	if found, err := store.Reconcile(ctx, d); err != nil || len(found) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", found, err, "[]", nil))
+	}
+	if _, err := d.Ledger(ctx, types.NewID()); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestGrantBudget tests that grants add to the budget and go in the ledger with their note, and that budgets can't be taken below zero, nor deactivated users given any.
+func TestGrantBudget(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	user := types.User{Name: "Orange", Username: "orange", Budget: 2, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &user); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if updated, err := d.GrantBudget(ctx, user.ID, 5, "Apology.", time.Now()); err != nil || updated.Budget != 7 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", updated.Budget, err, 7, nil))
+	}
+	if updated, err := d.GrantBudget(ctx, user.ID, -7, "Spam.", time.Now()); err != nil || updated.Budget != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", updated.Budget, err, 0, nil))
+	}
+	if _, err := d.GrantBudget(ctx, user.ID, -1, "More spam.", time.Now()); !errors.Is(err, store.ErrBudgetExhausted) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrBudgetExhausted))
+	}
+	entries, err := d.Ledger(ctx, user.ID)
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	expected := "[open 2 2 ] [grant 5 7 Apology.] [grant -7 0 Spam.]"
+	actual := ""
+	for _, e := range entries {
+		actual += fmt.Sprintf(" [%s %d %d %s]", e.Reason, e.Amount, e.Balance, e.Note)
+	}
+	if strings.TrimSpace(actual) != expected {
+		t.Error(fmt.Sprintf("Actual: %s\tExpected: %s", actual, expected))
+	}
+	if found, err := store.Reconcile(ctx, d); err != nil || len(found) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", found, err, "[]", nil))
+	}
+	if _, err := d.DeactivateUser(ctx, user.ID, time.Now()); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.GrantBudget(ctx, user.ID, 1, "Hi.", time.Now()); !errors.Is(err, store.ErrConflict) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	if _, err := d.GrantBudget(ctx, types.NewID(), 1, "Hi.", time.Now()); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestBootstrapMigrations tests that bootstrapping a new database records every migration as applied, since there's nothing for them to do.
+func TestBootstrapMigrations(t *testing.T) {
+	d := testSession(t)
+	if pending, err := migrate.Pending(context.Background(), d); err != nil || pending != 0 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", pending, err, 0, nil))
+	}
+}
+
+// TestBootstrapSharedDatabase tests that a new store is recognised as new even in a database that already holds someone else's collections, and that a store whose collections already exist isn't taken for new just because it has no migrations recorded.
+func TestBootstrapSharedDatabase(t *testing.T) {
+	d := testSession(t)
+	ctx := context.Background()
+	names := Names{Database: d.Names.Database, Users: "other_users", Messages: "other_messages", Ledger: "other_ledger", Migrations: "other_migrations"}
+	other := DBObject{d.Client, names}
+	if err := other.Bootstrap(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if pending, err := migrate.Pending(ctx, other); err != nil || pending != 0 {
+		t.Error(fmt.Sprintf("New store\tActual: %d - %v\tExpected: %d - %v", pending, err, 0, nil))
+	}
+	names = Names{Database: d.Names.Database, Users: "old_users", Messages: "old_messages", Ledger: "old_ledger", Migrations: "old_migrations"}
+	old := DBObject{d.Client, names}
+	if _, err := old.users().InsertOne(ctx, bson.M{"username": "orange"}); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if err := old.Bootstrap(ctx); err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	expected := len(old.Migrations())
+	if pending, err := migrate.Pending(ctx, old); err != nil || pending != expected {
+		t.Error(fmt.Sprintf("Old store\tActual: %d - %v\tExpected: %d - %v", pending, err, expected, nil))
+	}
+}
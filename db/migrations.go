@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ellenkorbes/chatty/migrate"
+	"github.com/ellenkorbes/chatty/types"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Migrations returns every migration this backend knows about. New ones go at the end, with the next version number.
+func (db DBObject) Migrations() []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "Replace ObjectId _ids with UUIDv7 IDs",
+			Up:          db.objectIDsToIDs,
+		},
+		{
+			Version:     2,
+			Description: "Open budget ledgers for users from before there was one",
+			Up:          db.openLedgers,
+		},
+		{
+			Version:     3,
+			Description: "Price messages from before messages had a price at 1, which is what they cost",
+			Up:          db.priceMessages,
+		},
+	}
+}
+
+// applied is how a migration is recorded in the migrations collection.
+type applied struct {
+	Version   int       `bson:"_id"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// Applied returns the versions applied so far, and when.
+func (db DBObject) Applied(ctx context.Context) (map[int]time.Time, error) {
+	all := []applied{}
+	err := findAll(ctx, db.migrations(), bson.M{}, byID, &all)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[int]time.Time, len(all))
+	for _, a := range all {
+		versions[a.Version] = a.AppliedAt
+	}
+	return versions, nil
+}
+
+// SetApplied records a version as applied, or as not applied anymore.
+func (db DBObject) SetApplied(ctx context.Context, version int, isApplied bool) error {
+	if !isApplied {
+		_, err := db.migrations().DeleteOne(ctx, bson.M{"_id": version})
+		return storeError(err)
+	}
+	_, err := db.migrations().ReplaceOne(ctx, bson.M{"_id": version}, applied{version, time.Now()}, options.Replace().SetUpsert(true))
+	return storeError(err)
+}
+
+// objectIDsToIDs gives every user and message still keyed by an ObjectId, as the mgo-based code used to store them, a UUIDv7 ID for the time the ObjectId was created. There's no way back: nothing else needs the old IDs, and nothing could use them anymore.
+func (db DBObject) objectIDsToIDs(ctx context.Context) error {
+	for _, c := range []*mongo.Collection{db.users(), db.messages()} {
+		cursor, err := c.Find(ctx, bson.M{"_id": bson.M{"$type": "objectId"}})
+		if err != nil {
+			return storeError(err)
+		}
+		old := []bson.M{}
+		if err := cursor.All(ctx, &old); err != nil {
+			return storeError(err)
+		}
+		for _, doc := range old {
+			oid, ok := doc["_id"].(bson.ObjectID)
+			if !ok {
+				continue
+			}
+			// Usernames are unique, so the old document has to go before the new one can come in.
+			if _, err := c.DeleteOne(ctx, bson.M{"_id": oid}); err != nil {
+				return storeError(err)
+			}
+			doc["_id"] = types.NewIDAt(oid.Timestamp())
+			if _, err := c.InsertOne(ctx, doc); err != nil {
+				// Putting things back the way they were, so running this again can pick up where it left off.
+				doc["_id"] = oid
+				if _, rerr := c.InsertOne(context.Background(), doc); rerr != nil {
+					return fmt.Errorf("lost document %s in %s, here it is: %v: %w", oid.Hex(), c.Name(), doc, err)
+				}
+				return storeError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// openLedgers gives every user without a ledger an opening entry with their budget as it is, dated when they signed up, so their ledger adds up. Users that already have one are left alone, so running this again after a failure picks up where it left off. There's no way back: by the time anyone would want one, those ledgers have moved on.
+func (db DBObject) openLedgers(ctx context.Context) error {
+	ids := []types.ID{}
+	if err := db.ledger().Distinct(ctx, "userId", bson.M{}).Decode(&ids); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return storeError(err)
+	}
+	users := []types.User{}
+	if err := findAll(ctx, db.users(), bson.M{"_id": bson.M{"$nin": ids}}, byID, &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := db.record(ctx, user, types.LedgerEntry{Amount: user.Budget, Reason: types.ReasonOpen, CreatedAt: user.CreatedAt}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// priceMessages gives every message without a cost the 1 it cost back then. There's no way back: once rates change, there's no telling which ones were priced here.
+func (db DBObject) priceMessages(ctx context.Context) error {
+	_, err := db.messages().UpdateMany(ctx, bson.M{"cost": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"cost": 1}})
+	return storeError(err)
+}
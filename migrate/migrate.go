@@ -0,0 +1,129 @@
+// Package migrate keeps stored data in step with the code. Each backend lists the migrations it knows about and remembers which ones it has applied; this package works out what's pending and runs it in order.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Migration is one step in the evolution of the stored data. Versions start at 1 and must be unique within a backend.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(context.Context) error // Applies the change.
+	Down        func(context.Context) error // Reverts it. Nil means there's no going back.
+}
+
+// Store is a backend that can be migrated.
+type Store interface {
+	Migrations() []Migration                            // Every migration this backend knows about, in any order.
+	Applied(context.Context) (map[int]time.Time, error) // The versions applied so far, and when.
+	SetApplied(context.Context, int, bool) error        // Records a version as applied, or as not applied anymore.
+}
+
+// Status is a migration along with whether it has been applied.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// ErrIrreversible is returned by Down when the latest migration can't be reverted.
+var ErrIrreversible = errors.New("this migration can't be reverted")
+
+// ErrNothingApplied is returned by Down when there's nothing to revert.
+var ErrNothingApplied = errors.New("no migrations have been applied")
+
+// Up applies every pending migration, oldest version first, and returns the ones it applied. It stops at the first one that fails, so everything before it stays applied.
+func Up(ctx context.Context, s Store) ([]Migration, error) {
+	statuses, err := Statuses(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	done := []Migration{}
+	for _, status := range statuses {
+		if status.Applied {
+			continue
+		}
+		if err := status.Up(ctx); err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w", status.Version, status.Description, err)
+		}
+		if err := s.SetApplied(ctx, status.Version, true); err != nil {
+			return done, fmt.Errorf("recording migration %d: %w", status.Version, err)
+		}
+		done = append(done, status.Migration)
+	}
+	return done, nil
+}
+
+// Down reverts the latest applied migration and returns it.
+func Down(ctx context.Context, s Store) (Migration, error) {
+	statuses, err := Statuses(ctx, s)
+	if err != nil {
+		return Migration{}, err
+	}
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if !statuses[i].Applied {
+			continue
+		}
+		m := statuses[i].Migration
+		if m.Down == nil {
+			return m, ErrIrreversible
+		}
+		if err := m.Down(ctx); err != nil {
+			return m, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		if err := s.SetApplied(ctx, m.Version, false); err != nil {
+			return m, fmt.Errorf("recording migration %d: %w", m.Version, err)
+		}
+		return m, nil
+	}
+	return Migration{}, ErrNothingApplied
+}
+
+// Baseline records every migration as applied without running any of them. It's for stores that were just created, which already have the shape the code expects, so there's nothing for the migrations to do.
+func Baseline(ctx context.Context, s Store) error {
+	for _, m := range s.Migrations() {
+		if err := s.SetApplied(ctx, m.Version, true); err != nil {
+			return fmt.Errorf("recording migration %d: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// Statuses returns every migration the store knows about, oldest version first, and whether each has been applied.
+func Statuses(ctx context.Context, s Store) ([]Status, error) {
+	applied, err := s.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	migrations := s.Migrations()
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	statuses := make([]Status, 0, len(migrations))
+	for i, m := range migrations {
+		if i > 0 && migrations[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migration %d is listed twice", m.Version)
+		}
+		at, ok := applied[m.Version]
+		statuses = append(statuses, Status{Migration: m, Applied: ok, AppliedAt: at})
+	}
+	return statuses, nil
+}
+
+// Pending returns how many migrations haven't been applied yet.
+func Pending(ctx context.Context, s Store) (int, error) {
+	statuses, err := Statuses(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, status := range statuses {
+		if !status.Applied {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,100 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeStore is a Store whose migrations record the order they ran in.
+type fakeStore struct {
+	migrations []Migration
+	applied    map[int]time.Time
+	ran        []string
+}
+
+func (s *fakeStore) Migrations() []Migration { return s.migrations }
+
+func (s *fakeStore) Applied(ctx context.Context) (map[int]time.Time, error) { return s.applied, nil }
+
+func (s *fakeStore) SetApplied(ctx context.Context, version int, applied bool) error {
+	if applied {
+		s.applied[version] = time.Now()
+	} else {
+		delete(s.applied, version)
+	}
+	return nil
+}
+
+// step returns a migration that records itself in s when it runs, or fails if fail is set.
+func (s *fakeStore) step(version int, fail bool, reversible bool) Migration {
+	m := Migration{Version: version, Description: fmt.Sprint("step ", version)}
+	m.Up = func(context.Context) error {
+		if fail {
+			return errors.New("boom")
+		}
+		s.ran = append(s.ran, fmt.Sprint("up ", version))
+		return nil
+	}
+	if reversible {
+		m.Down = func(context.Context) error {
+			s.ran = append(s.ran, fmt.Sprint("down ", version))
+			return nil
+		}
+	}
+	return m
+}
+
+// TestUp tests that pending migrations run oldest first, skipping applied ones, and that a failure stops the run.
+func TestUp(t *testing.T) {
+	s := &fakeStore{applied: map[int]time.Time{1: time.Now()}}
+	s.migrations = []Migration{s.step(3, false, true), s.step(1, false, true), s.step(2, false, true)}
+	done, err := Up(context.Background(), s)
+	if err != nil || len(done) != 2 || fmt.Sprint(s.ran) != "[up 2 up 3]" {
+		t.Error(fmt.Sprintf("Actual: %v - %d - %v\tExpected: %v - %d - %v", s.ran, len(done), err, "[up 2 up 3]", 2, nil))
+	}
+	if pending, _ := Pending(context.Background(), s); pending != 0 {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", pending, 0))
+	}
+
+	s = &fakeStore{applied: map[int]time.Time{}}
+	s.migrations = []Migration{s.step(1, false, true), s.step(2, true, true), s.step(3, false, true)}
+	done, err = Up(context.Background(), s)
+	if err == nil || len(done) != 1 || fmt.Sprint(s.ran) != "[up 1]" {
+		t.Error(fmt.Sprintf("Actual: %v - %d - %v\tExpected: %v - %d - %s", s.ran, len(done), err, "[up 1]", 1, "an error"))
+	}
+	if pending, _ := Pending(context.Background(), s); pending != 2 {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", pending, 2))
+	}
+}
+
+// TestDown tests that Down reverts the latest applied migration only, and refuses to revert irreversible ones.
+func TestDown(t *testing.T) {
+	s := &fakeStore{applied: map[int]time.Time{1: time.Now(), 2: time.Now()}}
+	s.migrations = []Migration{s.step(1, false, false), s.step(2, false, true), s.step(3, false, true)}
+	m, err := Down(context.Background(), s)
+	if err != nil || m.Version != 2 || fmt.Sprint(s.ran) != "[down 2]" {
+		t.Error(fmt.Sprintf("Actual: %v - %d - %v\tExpected: %v - %d - %v", s.ran, m.Version, err, "[down 2]", 2, nil))
+	}
+	if _, err := Down(context.Background(), s); err != ErrIrreversible {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, ErrIrreversible))
+	}
+	delete(s.applied, 1)
+	if _, err := Down(context.Background(), s); err != ErrNothingApplied {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, ErrNothingApplied))
+	}
+}
+
+// TestBaseline tests that Baseline records every migration as applied without running any of them.
+func TestBaseline(t *testing.T) {
+	s := &fakeStore{applied: map[int]time.Time{}}
+	s.migrations = []Migration{s.step(1, false, true), s.step(2, true, true)}
+	if err := Baseline(context.Background(), s); err != nil || len(s.ran) != 0 {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", s.ran, err, "[]", nil))
+	}
+	if pending, _ := Pending(context.Background(), s); pending != 0 {
+		t.Error(fmt.Sprintf("Actual: %d\tExpected: %d", pending, 0))
+	}
+}
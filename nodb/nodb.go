@@ -1,104 +1,542 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/ellenkorbes/chatty/migrate"
+	"github.com/ellenkorbes/chatty/store"
 	"github.com/ellenkorbes/chatty/types"
-	mgo "gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
-// DBObject carries the MongoDB session and serves to inject all the code below.
+// DBObject is an in-memory stand-in for the MongoDB-backed db package. It's safe for concurrent use and keeps everything in insertion order. Nothing in here takes long once it has the lock, but waiting for the lock can, so contexts are checked as soon as it's ours.
 type DBObject struct {
-	Session *mgo.Session
+	mu        sync.RWMutex
+	users     map[types.ID]types.User
+	usernames map[string]types.ID
+	userOrder []types.ID
+	messages  map[types.ID]types.Message
+	msgOrder  []types.ID
+	ledgers   map[types.ID][]types.LedgerEntry
+	applied   map[int]time.Time
 }
 
-// NewSession opens a connection to the database.
-func NewSession(arg string) DBObject {
-	return DBObject{&mgo.Session{}}
+// Making sure we keep up with the interfaces.
+var (
+	_ store.UserStore    = &DBObject{}
+	_ store.MessageStore = &DBObject{}
+	_ migrate.Store      = &DBObject{}
+)
+
+// NewSession returns an empty in-memory database. The argument is ignored; it's only there so this package can be swapped in for the db package.
+func NewSession(arg string) *DBObject {
+	return &DBObject{
+		users:     map[types.ID]types.User{},
+		usernames: map[string]types.ID{},
+		messages:  map[types.ID]types.Message{},
+		ledgers:   map[types.ID][]types.LedgerEntry{},
+		applied:   map[int]time.Time{},
+	}
+}
+
+// NewFakeSession returns an in-memory database preloaded with FakeUsers and FakeMessages2, to be used for testing.
+func NewFakeSession() *DBObject {
+	db := NewSession("")
+	users := []types.User{}
+	messages := []types.Message{}
+	json.Unmarshal(FakeUsers, &users)
+	json.Unmarshal(FakeMessages2, &messages)
+	for i := range users {
+		db.AddUser(context.Background(), &users[i])
+	}
+	// These are stored as they are. There's no point charging anyone for fixtures.
+	for i := range messages {
+		db.messages[messages[i].ID] = messages[i]
+		db.msgOrder = append(db.msgOrder, messages[i].ID)
+	}
+	return db
 }
 
+// Close does nothing. There's nothing to close.
+func (db *DBObject) Close() {}
+
 // FakeUser is a mock user, to be used for testing.
-var FakeUser = []byte(`{"id":"5a8d75057d9b53706595116a","budget":7,"name":"Orange","username":"orange","createdAt":"2018-02-21T13:32:53.509Z","updatedAt":"2018-02-25T18:27:25.239Z"}`)
+var FakeUser = []byte(`{"id":"0161b891-1d85-7b4c-9133-da73a7113224","budget":7,"name":"Orange","username":"orange","createdAt":"2018-02-21T13:32:53.509Z","updatedAt":"2018-02-25T18:27:25.239Z"}`)
 
 // FakeUsers is a mock list of users, to be used for testing.
-var FakeUsers = []byte(`[{"id":"5a8d75057d9b53706595116a","budget":7,"name":"Orange","username":"orange","createdAt":"2018-02-21T13:32:53.509Z","updatedAt":"2018-02-25T18:27:25.239Z"},{"id":"5a8d750d7d9b53706595116b","budget":7,"name":"Banana","username":"banana","createdAt":"2018-02-21T13:33:01.239Z","updatedAt":"2018-02-25T16:50:55.969Z"}]`)
+var FakeUsers = []byte(`[{"id":"0161b891-1d85-7b4c-9133-da73a7113224","budget":7,"name":"Orange","username":"orange","createdAt":"2018-02-21T13:32:53.509Z","updatedAt":"2018-02-25T18:27:25.239Z"},{"id":"0161b891-3bb7-7493-9483-64afe44d11c0","budget":7,"name":"Banana","username":"banana","createdAt":"2018-02-21T13:33:01.239Z","updatedAt":"2018-02-25T16:50:55.969Z"}]`)
 
 // FakeMessage is a mock message, to be used for testing.
-var FakeMessage = []byte(`{"id":"5a93000c7d9b532f98e8bba2","from":"orange","to":"banana","body":"This is a test message.","sentAt":"2018-02-25T18:27:24.885Z"}`)
+var FakeMessage = []byte(`{"id":"0161ce38-3255-79c1-b289-e7522195b362","from":"orange","to":"banana","body":"This is a test message.","cost":1,"sentAt":"2018-02-25T18:27:24.885Z"}`)
 
-// FakeMessages1 is a mock list of messages, to be used for testing.
-var FakeMessages1 = []byte(`{"messages":[{"id":"5a8d766c7d9b537448d19b2f","from":"banana","to":"orange","body":"Message.","sentAt":"2018-02-21T13:38:52.358Z"},{"id":"5a93000c7d9b532f98e8bba2","from":"orange","to":"banana","body":"This is a test message.","sentAt":"2018-02-25T18:27:24.885Z"}]}`)
+// FakeMessages1 is the list of messages addressed to FakeUser, to be used for testing.
+var FakeMessages1 = []byte(`{"messages":[{"id":"0161b896-9746-7a0d-b2c9-5aa144c1d0ff","from":"banana","to":"orange","body":"Message.","cost":1,"sentAt":"2018-02-21T13:38:52.358Z"}],"unread":1}`)
 
-// FakeMessages2 is another mock list of messages, to be used for testing.
-var FakeMessages2 = []byte(`[{"id":"5a8d766c7d9b537448d19b2f","from":"banana","to":"orange","body":"Message.","sentAt":"2018-02-21T13:38:52.358Z"},{"id":"5a93000c7d9b532f98e8bba2","from":"orange","to":"banana","body":"This is a test message.","sentAt":"2018-02-25T18:27:24.885Z"}]`)
+// FakeMessages2 is a mock list of all messages, to be used for testing.
+var FakeMessages2 = []byte(`[{"id":"0161b896-9746-7a0d-b2c9-5aa144c1d0ff","from":"banana","to":"orange","body":"Message.","cost":1,"sentAt":"2018-02-21T13:38:52.358Z"},{"id":"0161ce38-3255-79c1-b289-e7522195b362","from":"orange","to":"banana","body":"This is a test message.","cost":1,"sentAt":"2018-02-25T18:27:24.885Z"}]`)
 
-// Add returns nil to simulate a successful DB addition.
-func (db DBObject) Add(entry interface{}) error {
+// AddUser stores a new user. Users without an ID get a new one.
+func (db *DBObject) AddUser(ctx context.Context, user *types.User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if user.ID == "" {
+		user.ID = types.NewID()
+	}
+	if _, ok := db.users[user.ID]; ok {
+		return store.ErrConflict
+	}
+	if _, ok := db.usernames[user.Username]; ok {
+		return store.ErrDuplicate
+	}
+	db.users[user.ID] = *user
+	db.usernames[user.Username] = user.ID
+	db.userOrder = append(db.userOrder, user.ID)
+	db.record(*user, types.LedgerEntry{Amount: user.Budget, Reason: types.ReasonOpen, CreatedAt: user.CreatedAt})
 	return nil
 }
 
-// Get gets a fake user or message, depending on the type of the saveTo argument.
-func (db DBObject) Get(id bson.ObjectId, saveTo interface{}) error {
-	switch saveTo.(type) {
-	case *types.User:
-		json.Unmarshal(FakeUser, saveTo)
-		return nil
-	case *types.Message:
-		json.Unmarshal(FakeMessage, saveTo)
-		return nil
+// GetUserByID gets a user by ID.
+func (db *DBObject) GetUserByID(ctx context.Context, id types.ID) (types.User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return types.User{}, err
 	}
-	return nil
+	user, ok := db.users[id]
+	if !ok {
+		return types.User{}, store.ErrNotFound
+	}
+	return user, nil
+}
+
+// GetUser gets the full User object for a username.
+func (db *DBObject) GetUser(ctx context.Context, user string) (types.User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return types.User{}, err
+	}
+	id, ok := db.usernames[user]
+	if !ok {
+		return types.User{}, store.ErrNotFound
+	}
+	return db.users[id], nil
+}
+
+// ListUsers gets every user, oldest first.
+func (db *DBObject) ListUsers(ctx context.Context) ([]types.User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	all := make([]types.User, 0, len(db.userOrder))
+	for _, id := range db.userOrder {
+		all = append(all, db.users[id])
+	}
+	return all, nil
+}
+
+// IsUnique checks whether a username is already present in the database.
+func (db *DBObject) IsUnique(ctx context.Context, user types.User) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	_, taken := db.usernames[user.Username]
+	return !taken, nil
+}
+
+// UpdateUser changes a user's name and username, and returns the user. A new username carries over to every message they've sent or received.
+func (db *DBObject) UpdateUser(ctx context.Context, id types.ID, name string, username string, at time.Time) (types.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return types.User{}, err
+	}
+	user, ok := db.users[id]
+	switch {
+	case !ok:
+		return types.User{}, store.ErrNotFound
+	case user.DeactivatedAt != nil:
+		return types.User{}, store.ErrConflict
+	}
+	if old := user.Username; username != old {
+		if _, taken := db.usernames[username]; taken {
+			return types.User{}, store.ErrDuplicate
+		}
+		delete(db.usernames, old)
+		db.usernames[username] = id
+		for mid, m := range db.messages {
+			if m.From == old || m.To == old {
+				if m.From == old {
+					m.From = username
+				}
+				if m.To == old {
+					m.To = username
+				}
+				db.messages[mid] = m
+			}
+		}
+	}
+	user.Name, user.Username, user.UpdatedAt = name, username, at
+	db.users[id] = user
+	return user, nil
+}
+
+// DeactivateUser deactivates a user, and returns it.
+func (db *DBObject) DeactivateUser(ctx context.Context, id types.ID, at time.Time) (types.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return types.User{}, err
+	}
+	user, ok := db.users[id]
+	switch {
+	case !ok:
+		return types.User{}, store.ErrNotFound
+	case user.DeactivatedAt != nil:
+		return types.User{}, store.ErrConflict
+	}
+	user.DeactivatedAt, user.UpdatedAt = &at, at
+	db.users[id] = user
+	return user, nil
+}
+
+// SetBudget sets a user's budget and when it next resets, as long as both are still what they are in the given user, and returns the user.
+func (db *DBObject) SetBudget(ctx context.Context, old types.User, budget int, resetsAt *time.Time) (types.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return types.User{}, err
+	}
+	user, ok := db.users[old.ID]
+	switch {
+	case !ok:
+		return types.User{}, store.ErrNotFound
+	case user.Budget != old.Budget || !store.SameTime(user.BudgetResetsAt, old.BudgetResetsAt):
+		return types.User{}, store.ErrConflict
+	}
+	amount := budget - user.Budget
+	user.Budget, user.BudgetResetsAt = budget, resetsAt
+	db.users[old.ID] = user
+	if amount != 0 {
+		db.record(user, types.LedgerEntry{Amount: amount, Reason: types.ReasonRefill, CreatedAt: time.Now()})
+	}
+	return user, nil
 }
 
-// GetAll gets list of "all" fake users or messages, depending on the type of the saveTo argument.
-func (db DBObject) GetAll(saveTo interface{}) error {
-	switch saveTo.(type) {
-	case *[]types.User:
-		json.Unmarshal(FakeUsers, saveTo)
-		return nil
-	case *[]types.Message:
-		json.Unmarshal(FakeMessages2, saveTo)
-		return nil
+// GrantBudget adds to a user's budget, or takes away when negative, and returns the user.
+func (db *DBObject) GrantBudget(ctx context.Context, id types.ID, amount int, note string, at time.Time) (types.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return types.User{}, err
+	}
+	user, ok := db.users[id]
+	switch {
+	case !ok:
+		return types.User{}, store.ErrNotFound
+	case user.DeactivatedAt != nil:
+		return types.User{}, store.ErrConflict
+	case user.Budget+amount < 0:
+		return types.User{}, store.ErrBudgetExhausted
+	}
+	user.Budget += amount
+	user.UpdatedAt = at
+	db.users[id] = user
+	db.record(user, types.LedgerEntry{Amount: amount, Reason: types.ReasonGrant, Note: note, CreatedAt: at})
+	return user, nil
+}
+
+// Ledger gets every change to a user's budget, oldest first.
+func (db *DBObject) Ledger(ctx context.Context, id types.ID) ([]types.LedgerEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := db.users[id]; !ok {
+		return nil, store.ErrNotFound
+	}
+	return append([]types.LedgerEntry{}, db.ledgers[id]...), nil
+}
+
+// record adds an entry to a user's ledger, for a change that's already been made to their budget. The entry gets its ID, user ID, and balance from here. Callers must hold the lock.
+func (db *DBObject) record(user types.User, entry types.LedgerEntry) {
+	entry.ID, entry.UserID, entry.Balance = types.NewID(), user.ID, user.Budget
+	db.ledgers[user.ID] = append(db.ledgers[user.ID], entry)
+}
+
+// SendMessage charges the sender the message's cost and stores the message, all under the same lock. Senders who can't afford it get store.ErrBudgetExhausted and nothing is stored.
+func (db *DBObject) SendMessage(ctx context.Context, message *types.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id, ok := db.usernames[message.From]
+	if !ok {
+		return store.ErrNotFound
+	}
+	sender := db.users[id]
+	if sender.Budget < message.Cost {
+		return store.ErrBudgetExhausted
+	}
+	if message.ID == "" {
+		message.ID = types.NewID()
 	}
+	if _, ok := db.messages[message.ID]; ok {
+		return store.ErrConflict
+	}
+	sender.Budget -= message.Cost
+	sender.UpdatedAt = time.Now()
+	db.users[id] = sender
+	db.record(sender, types.LedgerEntry{Amount: -message.Cost, Reason: types.ReasonSend, MessageID: message.ID, CreatedAt: sender.UpdatedAt})
+	db.messages[message.ID] = *message
+	db.msgOrder = append(db.msgOrder, message.ID)
 	return nil
 }
 
-// GetUser returns a fake user object.
-func (db DBObject) GetUser(user string) (types.User, error) {
-	x := types.User{}
-	json.Unmarshal(FakeUser, &x)
-	return x, nil
+// GetMessage gets a message by ID.
+func (db *DBObject) GetMessage(ctx context.Context, id types.ID) (types.Message, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return types.Message{}, err
+	}
+	message, ok := db.messages[id]
+	if !ok {
+		return types.Message{}, store.ErrNotFound
+	}
+	return message, nil
+}
+
+// ListMessages gets every message, oldest first.
+func (db *DBObject) ListMessages(ctx context.Context) ([]types.Message, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	all := make([]types.Message, 0, len(db.msgOrder))
+	for _, id := range db.msgOrder {
+		all = append(all, db.messages[id])
+	}
+	return all, nil
+}
+
+// FindMessages gets a page of the messages matching a query.
+func (db *DBObject) FindMessages(ctx context.Context, q store.MessageQuery) (types.Messages, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return types.Messages{}, err
+	}
+	sm := []types.Message{}
+	for _, id := range db.msgOrder {
+		if q.Matches(db.messages[id]) {
+			sm = append(sm, db.messages[id])
+		}
+	}
+	return q.Page(sm), nil
+}
+
+// Conversations sums up everyone a username has exchanged messages with, most recent first.
+func (db *DBObject) Conversations(ctx context.Context, username string) ([]types.Conversation, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sm := []types.Message{}
+	for _, id := range db.msgOrder {
+		if m := db.messages[id]; m.From == username || m.To == username {
+			sm = append(sm, m)
+		}
+	}
+	return store.Summarize(username, sm), nil
+}
+
+// Replies gets every direct reply to any of the messages, oldest first.
+func (db *DBObject) Replies(ctx context.Context, ids []types.ID) ([]types.Message, error) {
+	parents := make(map[types.ID]bool, len(ids))
+	for _, id := range ids {
+		parents[id] = true
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sm := []types.Message{}
+	for _, id := range db.msgOrder {
+		if m := db.messages[id]; m.ReplyTo != "" && parents[m.ReplyTo] {
+			sm = append(sm, m)
+		}
+	}
+	sort.Slice(sm, func(i, j int) bool { return store.Less(sm[i], sm[j]) })
+	return sm, nil
 }
 
-// DecreaseBudget returns nil to simulate a successful DecreaseBudget operation.
-func (db DBObject) DecreaseBudget(sender types.User) error {
+// DeliverMessages records when messages showed up in their recipient's inbox, for the ones that hadn't yet.
+func (db *DBObject) DeliverMessages(ctx context.Context, ids []types.ID, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if m, ok := db.messages[id]; ok && m.DeliveredAt == nil {
+			m.DeliveredAt = &at
+			db.messages[id] = m
+		}
+	}
 	return nil
 }
 
-// GetMessagesByUser returns a fake list of messages.
-func (db DBObject) GetMessagesByUser(user string) (types.Messages, error) {
-	x := types.Messages{}
-	json.Unmarshal(FakeMessages1, &x)
-	return x, nil
+// ReadMessage records when the recipient read a message, unless they already had, and returns it. Reading a message delivers it too.
+func (db *DBObject) ReadMessage(ctx context.Context, id types.ID, at time.Time) (types.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return types.Message{}, err
+	}
+	m, ok := db.messages[id]
+	if !ok {
+		return types.Message{}, store.ErrNotFound
+	}
+	db.messages[id] = markRead(m, at)
+	return db.messages[id], nil
+}
+
+// ReadMessages records when the recipient read every unread message matching a query, and says how many there were.
+func (db *DBObject) ReadMessages(ctx context.Context, q store.MessageQuery, at time.Time) (int, error) {
+	q.Unread, q.After = true, nil
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, id := range db.msgOrder {
+		if m := db.messages[id]; q.Matches(m) {
+			db.messages[id] = markRead(m, at)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// CountUnread counts the messages a username hasn't read yet.
+func (db *DBObject) CountUnread(ctx context.Context, username string) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, m := range db.messages {
+		if m.To == username && m.ReadAt == nil && m.DeletedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// EditMessage replaces the body of a message, keeping the old one in its revisions, and returns it.
+func (db *DBObject) EditMessage(ctx context.Context, id types.ID, body string, at time.Time) (types.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return types.Message{}, err
+	}
+	m, ok := db.messages[id]
+	switch {
+	case !ok:
+		return types.Message{}, store.ErrNotFound
+	case m.DeletedAt != nil:
+		return types.Message{}, store.ErrConflict
+	}
+	written := m.SentAt
+	if m.EditedAt != nil {
+		written = *m.EditedAt
+	}
+	// A fresh slice, so messages handed out earlier keep their own revisions.
+	m.Revisions = append(append([]types.Revision{}, m.Revisions...), types.Revision{Body: m.Body, WrittenAt: written})
+	m.Body, m.EditedAt = body, &at
+	db.messages[id] = m
+	return m, nil
+}
+
+// DeleteMessage turns a message into a tombstone: its body and revisions go, and DeletedAt says when.
+func (db *DBObject) DeleteMessage(ctx context.Context, id types.ID, at time.Time) (types.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return types.Message{}, err
+	}
+	m, ok := db.messages[id]
+	switch {
+	case !ok:
+		return types.Message{}, store.ErrNotFound
+	case m.DeletedAt != nil:
+		return types.Message{}, store.ErrConflict
+	}
+	m.Body, m.Revisions, m.EditedAt, m.DeletedAt = "", nil, nil, &at
+	db.messages[id] = m
+	return m, nil
 }
 
-// IsUnique returns fake value indicating there are no duplicates in the database.
-func (db DBObject) IsUnique(user types.User) (bool, error) {
-	return true, nil
+// markRead returns the message marked as read, and delivered, at the time given. Messages already read stay as they were.
+func markRead(m types.Message, at time.Time) types.Message {
+	if m.ReadAt != nil {
+		return m
+	}
+	if m.DeliveredAt == nil {
+		m.DeliveredAt = &at
+	}
+	m.ReadAt = &at
+	return m
+}
+
+// Migrations returns nothing. Every session starts out empty and up to date, so there's never anything to migrate.
+func (db *DBObject) Migrations() []migrate.Migration {
+	return nil
 }
 
-// CollectionByType returns the fitting collection name based on the type of the object supplied.
-func CollectionByType(x interface{}) string {
-	switch x.(type) {
-	case *types.User:
-		return "users"
-	case *[]types.User:
-		return "users"
-	case *types.Message:
-		return "messages"
-	case *[]types.Message:
-		return "messages"
+// Applied returns the versions applied so far, and when.
+func (db *DBObject) Applied(ctx context.Context) (map[int]time.Time, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return ""
+	applied := make(map[int]time.Time, len(db.applied))
+	for version, at := range db.applied {
+		applied[version] = at
+	}
+	return applied, nil
+}
+
+// SetApplied records a version as applied, or as not applied anymore.
+func (db *DBObject) SetApplied(ctx context.Context, version int, applied bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if applied {
+		db.applied[version] = time.Now()
+	} else {
+		delete(db.applied, version)
+	}
+	return nil
 }
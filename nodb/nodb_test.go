@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ellenkorbes/chatty/store"
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// TestUsers tests that usernames are unique, and that users can't be found where they don't exist.
+func TestUsers(t *testing.T) {
+	d := NewFakeSession()
+	ctx := context.Background()
+	twin := types.User{Name: "Other Orange", Username: "orange", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &twin); !errors.Is(err, store.ErrDuplicate) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrDuplicate))
+	}
+	if users, err := d.ListUsers(ctx); err != nil || len(users) != 2 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", len(users), err, 2, nil))
+	}
+	if _, err := d.GetUser(ctx, "apple"); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	if _, err := d.GetUserByID(ctx, types.NewID()); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	if _, err := d.Ledger(ctx, types.NewID()); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	if _, err := d.GetMessage(ctx, types.NewID()); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestSetBudget tests that setting a budget only goes through while it's still what the caller last saw.
+func TestSetBudget(t *testing.T) {
+	d := NewFakeSession()
+	ctx := context.Background()
+	seen, err := d.GetUser(ctx, "orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	resetsAt := time.Now().Add(time.Hour)
+	if user, err := d.SetBudget(ctx, seen, 10, &resetsAt); err != nil || user.Budget != 10 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", user.Budget, err, 10, nil))
+	}
+	// Someone else's write got in first, as far as this one is concerned.
+	if _, err := d.SetBudget(ctx, seen, 3, nil); !errors.Is(err, store.ErrConflict) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrConflict))
+	}
+	user, err := d.GetUser(ctx, "orange")
+	if err != nil || user.Budget != 10 || !store.SameTime(user.BudgetResetsAt, &resetsAt) {
+		t.Error(fmt.Sprintf("Actual: %d - %v - %v\tExpected: %d - %v - %v", user.Budget, user.BudgetResetsAt, err, 10, resetsAt, nil))
+	}
+	if entries, err := d.Ledger(ctx, user.ID); err != nil || len(entries) != 2 || entries[1].Amount != 3 || entries[1].Reason != types.ReasonRefill {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: an opening entry and a refill of %d - %v", entries, err, 3, nil))
+	}
+	if _, err := d.SetBudget(ctx, types.User{ID: types.NewID()}, 3, nil); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+}
+
+// TestUpdateUser tests that renaming a user takes their messages along, frees up the old username, and won't take a username that's in use.
+func TestUpdateUser(t *testing.T) {
+	d := NewFakeSession()
+	ctx := context.Background()
+	orange, err := d.GetUser(ctx, "orange")
+	if err != nil {
+		t.Fatal(fmt.Sprintln("Unknown error:", err))
+	}
+	if _, err := d.UpdateUser(ctx, orange.ID, "Orange", "banana", time.Now()); !errors.Is(err, store.ErrDuplicate) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrDuplicate))
+	}
+	if user, err := d.UpdateUser(ctx, orange.ID, "Clementine", "clementine", time.Now()); err != nil || user.Username != "clementine" || user.Name != "Clementine" {
+		t.Error(fmt.Sprintf("Actual: %s - %s - %v\tExpected: %s - %s - %v", user.Name, user.Username, err, "Clementine", "clementine", nil))
+	}
+	if _, err := d.GetUser(ctx, "orange"); !errors.Is(err, store.ErrNotFound) {
+		t.Error(fmt.Sprintf("Actual: %v\tExpected: %v", err, store.ErrNotFound))
+	}
+	if user, err := d.GetUser(ctx, "clementine"); err != nil || user.ID != orange.ID {
+		t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", user.ID, err, orange.ID, nil))
+	}
+	messages, err := d.ListMessages(ctx)
+	if err != nil || len(messages) != 2 {
+		t.Fatal(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", len(messages), err, 2, nil))
+	}
+	// One of them is from orange and the other one is to orange, so both should have changed.
+	for _, m := range messages {
+		if m.From == "orange" || m.To == "orange" || (m.From != "clementine" && m.To != "clementine") {
+			t.Error(fmt.Sprintf("Actual: %s to %s\tExpected: clementine on one end", m.From, m.To))
+		}
+	}
+	if found, err := d.FindMessages(ctx, store.MessageQuery{To: "clementine"}); err != nil || len(found.Entries) != 1 {
+		t.Error(fmt.Sprintf("Actual: %d - %v\tExpected: %d - %v", len(found.Entries), err, 1, nil))
+	}
+	// The old username is up for grabs again.
+	user := types.User{Name: "Orange", Username: "orange", Budget: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := d.AddUser(ctx, &user); err != nil {
+		t.Error(fmt.Sprintln("Unknown error:", err))
+	}
+}
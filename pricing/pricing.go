@@ -0,0 +1,75 @@
+// Package pricing works out what messages cost to send. Each deployment picks one set of Rates, and messages are priced when they're sent, so senders pay what the rates said at the time, whatever they say later.
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// ErrBadRates is returned by Parse when it can't make sense of a set of rates.
+var ErrBadRates = errors.New(`invalid pricing, it goes as base:N, optionally followed by ,length:N and ,high:N, as in base:1,length:70,high:2`)
+
+// Rates say what messages cost. Every message costs Base. Bodies longer than Length characters cost one more for every Length characters after the first Length, or part thereof, and high priority messages cost High more.
+type Rates struct {
+	Base   int // What every message costs. At least 1, so there's no sending for free.
+	Length int // How many characters of body Base pays for, and how many more each extra unit does. Zero means length is free.
+	High   int // What high priority adds.
+}
+
+// Default is what messages cost unless told otherwise: 1, whatever they are.
+var Default = Rates{Base: 1}
+
+// Cost returns what a message costs to send.
+func (r Rates) Cost(m types.Message) int {
+	cost := r.Base
+	if r.Length > 0 && len(m.Body) > r.Length {
+		cost += (len(m.Body) - 1) / r.Length
+	}
+	if m.Priority == types.PriorityHigh {
+		cost += r.High
+	}
+	return cost
+}
+
+// String returns the rates in the form Parse takes, leaving out the parts that are zero.
+func (r Rates) String() string {
+	s := fmt.Sprint("base:", r.Base)
+	if r.Length > 0 {
+		s += fmt.Sprint(",length:", r.Length)
+	}
+	if r.High > 0 {
+		s += fmt.Sprint(",high:", r.High)
+	}
+	return s
+}
+
+// Parse turns rates in the form base:N,length:N,high:N into Rates. Only base is required, and the parts can come in any order.
+func Parse(s string) (Rates, error) {
+	r, seen := Rates{}, map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		kind, arg, _ := strings.Cut(part, ":")
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 || seen[kind] {
+			return Rates{}, ErrBadRates
+		}
+		seen[kind] = true
+		switch kind {
+		case "base":
+			r.Base = n
+		case "length":
+			r.Length = n
+		case "high":
+			r.High = n
+		default:
+			return Rates{}, ErrBadRates
+		}
+	}
+	if r.Base < 1 {
+		return Rates{}, ErrBadRates
+	}
+	return r, nil
+}
@@ -0,0 +1,55 @@
+package pricing
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// TestCost tests pricing messages of all sorts of lengths and priorities, right around where each extra unit kicks in.
+func TestCost(t *testing.T) {
+	rates := Rates{Base: 1, Length: 70, High: 2}
+	tests := []struct {
+		rates    Rates
+		length   int
+		priority string
+		expected int
+	}{
+		{Default, 280, types.PriorityHigh, 1},
+		{rates, 1, "", 1},
+		{rates, 70, "", 1},
+		{rates, 71, "", 2},
+		{rates, 140, types.PriorityNormal, 2},
+		{rates, 141, "", 3},
+		{rates, 280, "", 4},
+		{rates, 1, types.PriorityHigh, 3},
+		{rates, 280, types.PriorityHigh, 6},
+		{Rates{Base: 3}, 280, types.PriorityHigh, 3},
+	}
+	for _, test := range tests {
+		message := types.Message{Body: strings.Repeat("a", test.length), Priority: test.priority}
+		if cost := test.rates.Cost(message); cost != test.expected {
+			t.Error(fmt.Sprintf("%s %d %q\tActual: %d\tExpected: %d", test.rates, test.length, test.priority, cost, test.expected))
+		}
+	}
+}
+
+// TestParse tests that rates come back out of Parse the same as they went in, and that nonsense doesn't.
+func TestParse(t *testing.T) {
+	for _, s := range []string{"base:1", "base:2,length:70", "base:1,high:3", "base:1,length:70,high:2"} {
+		rates, err := Parse(s)
+		if err != nil || rates.String() != s {
+			t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %s - %v", rates, err, s, nil))
+		}
+	}
+	if rates, err := Parse("high:2,base:1"); err != nil || rates != (Rates{Base: 1, High: 2}) {
+		t.Error(fmt.Sprintf("Actual: %v - %v\tExpected: %v - %v", rates, err, Rates{Base: 1, High: 2}, nil))
+	}
+	for _, s := range []string{"", "base:0", "length:70", "base:1,", "base:one", "base:1,length:-1", "base:1,base:2", "base:1,recipients:2"} {
+		if _, err := Parse(s); err != ErrBadRates {
+			t.Error(fmt.Sprintf("%q\tActual: %v\tExpected: %v", s, err, ErrBadRates))
+		}
+	}
+}
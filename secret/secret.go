@@ -3,6 +3,7 @@ package secret
 import (
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 )
 
 // Secret returns the value present in the secrets.txt file.
@@ -18,5 +19,6 @@ func Secret() string {
 	if err != nil {
 		return ""
 	}
-	return string(data)
+	// Editors love adding a trailing newline, and the MongoDB driver doesn't love URLs ending in one.
+	return strings.TrimSpace(string(data))
 }
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// Discrepancy is a user whose budget doesn't match what their ledger adds up to.
+type Discrepancy struct {
+	User   types.User
+	Ledger int // What the ledger adds up to.
+}
+
+// Balance adds up a ledger.
+func Balance(entries []types.LedgerEntry) int {
+	balance := 0
+	for _, e := range entries {
+		balance += e.Amount
+	}
+	return balance
+}
+
+// Reconcile goes through every user, recomputing their budget from their ledger, and returns the ones that don't match. Budgets that change while it runs may show up as a false alarm, so anything it finds is worth a second look before doing anything about it.
+func Reconcile(ctx context.Context, users UserStore) ([]Discrepancy, error) {
+	all, err := users.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := []Discrepancy{}
+	for _, user := range all {
+		entries, err := users.Ledger(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if balance := Balance(entries); balance != user.Budget {
+			found = append(found, Discrepancy{User: user, Ledger: balance})
+		}
+	}
+	return found, nil
+}
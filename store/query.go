@@ -0,0 +1,144 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// MessageQuery says which messages FindMessages should return. Blank fields don't filter anything, but deleted messages never match. Results always come sorted by SentAt, then by ID for messages sent at the same time, so paging through them is stable.
+type MessageQuery struct {
+	To         string    // Only messages addressed to this username.
+	From       string    // Only messages sent by this username.
+	EitherWay  bool      // Along with To and From, also messages going the other way, making it the whole conversation between them.
+	Since      time.Time // Only messages sent at this time or later.
+	Until      time.Time // Only messages sent before this time.
+	Through    *Cursor   // Only messages up to this one, included.
+	Unread     bool      // Only messages the recipient hasn't read yet.
+	Descending bool      // Newest first, rather than oldest first.
+	Limit      int       // At most this many messages. Zero means no limit.
+	After      *Cursor   // Only messages that come after this one in the listing, i.e. the next page.
+}
+
+// Cursor is a position in a message listing: the SentAt and ID of the last message on a page. Clients only ever see it as the opaque string returned by String.
+type Cursor struct {
+	SentAt time.Time `json:"t"`
+	ID     types.ID  `json:"id"`
+}
+
+// ErrBadCursor is returned by ParseCursor when the string isn't a cursor we handed out.
+var ErrBadCursor = errors.New("invalid cursor")
+
+// CursorOf returns the position of a message.
+func CursorOf(m types.Message) Cursor {
+	return Cursor{SentAt: m.SentAt, ID: m.ID}
+}
+
+// String returns the cursor in its opaque form, safe to use in a URL as is.
+func (c Cursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseCursor turns a string returned by Cursor.String back into a Cursor.
+func ParseCursor(s string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrBadCursor
+	}
+	c := Cursor{}
+	if err := json.Unmarshal(data, &c); err != nil || c.SentAt.IsZero() || !types.IsID(string(c.ID)) {
+		return Cursor{}, ErrBadCursor
+	}
+	return c, nil
+}
+
+// Less tells whether message a comes before message b in a listing.
+func Less(a, b types.Message) bool {
+	if !a.SentAt.Equal(b.SentAt) {
+		return a.SentAt.Before(b.SentAt)
+	}
+	return a.ID < b.ID
+}
+
+// Before tells whether message a comes before message b in the query's results.
+func (q MessageQuery) Before(a, b types.Message) bool {
+	if q.Descending {
+		return Less(b, a)
+	}
+	return Less(a, b)
+}
+
+// Matches tells whether a message belongs in the results of the query, regardless of Limit. Backends that can't do better may check every message with it, then call Page.
+func (q MessageQuery) Matches(m types.Message) bool {
+	if m.DeletedAt != nil {
+		return false
+	}
+	switch {
+	case q.EitherWay && m.To == q.From && m.From == q.To:
+		// Going the other way, which is fine too.
+	case q.To != "" && m.To != q.To:
+		return false
+	case q.From != "" && m.From != q.From:
+		return false
+	}
+	switch {
+	case !q.Since.IsZero() && m.SentAt.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !m.SentAt.Before(q.Until):
+		return false
+	case q.Through != nil && Less(types.Message{SentAt: q.Through.SentAt, ID: q.Through.ID}, m):
+		return false
+	case q.Unread && m.ReadAt != nil:
+		return false
+	case q.After != nil && !q.Before(types.Message{SentAt: q.After.SentAt, ID: q.After.ID}, m):
+		return false
+	}
+	return true
+}
+
+// Page sorts the messages matching the query and cuts them down to Limit. If anything was left out, Next points at where the next page starts. Backends that sort and limit on their own should ask for Limit+1 messages, so Page can tell whether there's more.
+func (q MessageQuery) Page(sm []types.Message) types.Messages {
+	sort.SliceStable(sm, func(i, j int) bool { return q.Before(sm[i], sm[j]) })
+	if q.Limit <= 0 || len(sm) <= q.Limit {
+		return types.Messages{Entries: sm}
+	}
+	sm = sm[:q.Limit]
+	return types.Messages{Entries: sm, Next: CursorOf(sm[len(sm)-1]).String()}
+}
+
+// Summarize sums up the conversations of a username, given every message they've sent or received, in any order. Deleted messages don't count. The conversations come out newest first.
+func Summarize(username string, sm []types.Message) []types.Conversation {
+	byUser := map[string]*types.Conversation{}
+	for _, m := range sm {
+		with := m.From
+		if m.DeletedAt != nil {
+			continue
+		} else if m.From == username {
+			with = m.To
+		} else if m.To != username {
+			continue
+		}
+		c, ok := byUser[with]
+		if !ok {
+			c = &types.Conversation{With: with, Last: m}
+			byUser[with] = c
+		}
+		if Less(c.Last, m) {
+			c.Last = m
+		}
+		if m.To == username && m.ReadAt == nil {
+			c.Unread++
+		}
+	}
+	all := make([]types.Conversation, 0, len(byUser))
+	for _, c := range byUser {
+		all = append(all, *c)
+	}
+	sort.Slice(all, func(i, j int) bool { return Less(all[j].Last, all[i].Last) })
+	return all
+}
@@ -0,0 +1,56 @@
+// Package store holds what every storage backend has in common, so the controller can deal with any of them the same way.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ellenkorbes/chatty/types"
+)
+
+// These are the errors every backend returns, wrapped or not, for the situations the controller cares about. Check them with errors.Is.
+var (
+	ErrNotFound        = errors.New("not found")        // The record doesn't exist.
+	ErrDuplicate       = errors.New("duplicate key")    // A unique field, such as a username, is already taken.
+	ErrBudgetExhausted = errors.New("budget exhausted") // The sender can't afford the message.
+	ErrConflict        = errors.New("conflict")         // The record was changed or created by someone else in the meantime.
+)
+
+// UserStore is where users live. Every method takes a context, and should give up and return the context's error once it's done.
+type UserStore interface {
+	AddUser(context.Context, *types.User) error                                          // Stores a new user, and opens their ledger with their budget. Users without an ID get a new one.
+	GetUserByID(context.Context, types.ID) (types.User, error)                           // Gets a user by ID.
+	GetUser(context.Context, string) (types.User, error)                                 // Gets a user by username.
+	ListUsers(context.Context) ([]types.User, error)                                     // Gets every user, oldest first.
+	IsUnique(context.Context, types.User) (bool, error)                                  // Checks whether the user's username is still free.
+	UpdateUser(context.Context, types.ID, string, string, time.Time) (types.User, error) // Changes a user's name and username, and returns the user. A new username carries over to every message they've sent or received. ErrDuplicate if it's taken, ErrConflict if the user is deactivated.
+	DeactivateUser(context.Context, types.ID, time.Time) (types.User, error)             // Deactivates a user, and returns it. ErrConflict if it's been deactivated already.
+	SetBudget(context.Context, types.User, int, *time.Time) (types.User, error)          // Sets a user's budget and when it next resets, as long as both are still what they are in the given user, and returns the user. The change goes in the ledger as a refill. ErrConflict if they've changed in the meantime.
+	GrantBudget(context.Context, types.ID, int, string, time.Time) (types.User, error)   // Adds to a user's budget, or takes away when negative, and returns the user. The change goes in the ledger as a grant, with the note. ErrBudgetExhausted if it would take the budget below zero, ErrConflict if the user is deactivated.
+	Ledger(context.Context, types.ID) ([]types.LedgerEntry, error)                       // Gets every change to a user's budget, oldest first. ErrNotFound if there's no such user.
+}
+
+// MessageStore is where messages live. Every method takes a context, and should give up and return the context's error once it's done.
+type MessageStore interface {
+	SendMessage(context.Context, *types.Message) error                               // Charges the sender the message's cost, recording it in their ledger, and stores the message, all or nothing. Messages without an ID get a new one. ErrBudgetExhausted if the sender can't afford it.
+	GetMessage(context.Context, types.ID) (types.Message, error)                     // Gets a message by ID.
+	ListMessages(context.Context) ([]types.Message, error)                           // Gets every message, oldest first.
+	FindMessages(context.Context, MessageQuery) (types.Messages, error)              // Gets a page of the messages matching a query.
+	Conversations(context.Context, string) ([]types.Conversation, error)             // Sums up everyone a username has exchanged messages with, most recent first.
+	Replies(context.Context, []types.ID) ([]types.Message, error)                    // Gets every direct reply to any of the messages, oldest first.
+	DeliverMessages(context.Context, []types.ID, time.Time) error                    // Records when messages showed up in their recipient's inbox, for the ones that hadn't yet.
+	ReadMessage(context.Context, types.ID, time.Time) (types.Message, error)         // Records when the recipient read a message, unless they already had, and returns it.
+	ReadMessages(context.Context, MessageQuery, time.Time) (int, error)              // Does the same for every unread message matching a query, regardless of Limit, and says how many there were.
+	CountUnread(context.Context, string) (int, error)                                // Counts the messages a username hasn't read yet.
+	EditMessage(context.Context, types.ID, string, time.Time) (types.Message, error) // Replaces the body of a message, keeping the old one in its revisions, and returns it. ErrConflict if it's been deleted.
+	DeleteMessage(context.Context, types.ID, time.Time) (types.Message, error)       // Turns a message into a tombstone and returns it. ErrConflict if it's been deleted already.
+}
+
+// SameTime tells whether two optional times are both missing, or both there and equal.
+func SameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
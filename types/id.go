@@ -0,0 +1,104 @@
+package types
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ID is the unique identifier of users and messages. It's a UUIDv7 (RFC 9562) in its canonical text form, e.g. "0161b818-3185-7a3c-8b2e-6f1d0c9e4a75". The first 48 bits are a millisecond timestamp, so IDs sort by creation time both as bytes and as text, and being a plain string it goes into JSON, BSON, or anything else as is.
+type ID string
+
+// ErrBadID is returned by ParseID when the string isn't a UUIDv7.
+var ErrBadID = errors.New("invalid ID")
+
+// The last timestamp and counter handed out by NewID, so IDs created within the same millisecond still come out in order.
+var (
+	idMutex   sync.Mutex
+	idLastMs  uint64
+	idCounter uint16
+)
+
+// NewID returns a new ID for the current time. Within one process, IDs always come out in increasing order: the 12 bits after the version are a counter that starts at a random value every millisecond.
+func NewID() ID {
+	var b [16]byte
+	rand.Read(b[:])
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	idMutex.Lock()
+	switch {
+	case ms > idLastMs:
+		// Leaving plenty of headroom below 0x0fff for the counter to grow into.
+		idLastMs, idCounter = ms, binary.BigEndian.Uint16(b[6:8])&0x07ff
+	case idCounter < 0x0fff:
+		// Same millisecond, or the clock went backwards. Either way, keep counting from where we were.
+		idCounter++
+	default:
+		// Out of counter. Borrow the next millisecond.
+		idLastMs, idCounter = idLastMs+1, binary.BigEndian.Uint16(b[6:8])&0x07ff
+	}
+	ms, counter := idLastMs, idCounter
+	idMutex.Unlock()
+	return build(ms, counter, b)
+}
+
+// NewIDAt returns a new ID for the time supplied, e.g. to give an ID to something created in the past. Unlike NewID, IDs for the same millisecond come out in random order.
+func NewIDAt(t time.Time) ID {
+	var b [16]byte
+	rand.Read(b[:])
+	return build(uint64(t.UnixNano()/int64(time.Millisecond)), binary.BigEndian.Uint16(b[6:8])&0x0fff, b)
+}
+
+// ParseID checks that s is a UUIDv7 and returns it as an ID, in lowercase.
+func ParseID(s string) (ID, error) {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return "", ErrBadID
+	}
+	var b [16]byte
+	if _, err := hex.Decode(b[:], []byte(strings.Replace(s, "-", "", 4))); err != nil {
+		return "", ErrBadID
+	}
+	if b[6]>>4 != 7 || b[8]>>6 != 2 {
+		return "", ErrBadID
+	}
+	return ID(format(b)), nil
+}
+
+// IsID checks whether s is a valid ID.
+func IsID(s string) bool {
+	_, err := ParseID(s)
+	return err == nil
+}
+
+// Time returns the time the ID was created at, to the millisecond. Invalid IDs return the zero time.
+func (id ID) Time() time.Time {
+	if !IsID(string(id)) {
+		return time.Time{}
+	}
+	b, _ := hex.DecodeString(string(id[0:8]) + string(id[9:13]))
+	ms := int64(b[0])<<40 | int64(b[1])<<32 | int64(binary.BigEndian.Uint32(b[2:6]))
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// String returns the ID as a string.
+func (id ID) String() string {
+	return string(id)
+}
+
+// build puts together a UUIDv7 from a millisecond timestamp, a 12 bit counter, and the random bytes in b[8:].
+func build(ms uint64, counter uint16, b [16]byte) ID {
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+	binary.BigEndian.PutUint16(b[6:8], 0x7000|counter)
+	b[8] = 0x80 | b[8]&0x3f
+	return ID(format(b))
+}
+
+// format writes out 16 bytes in the canonical 8-4-4-4-12 UUID layout.
+func format(b [16]byte) string {
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
@@ -0,0 +1,62 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestNewID tests that new IDs are valid, carry their creation time, and come out in order.
+func TestNewID(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	ids := make([]string, 10000)
+	for i := range ids {
+		ids[i] = NewID().String()
+	}
+	after := time.Now()
+	if !sort.StringsAreSorted(ids) {
+		t.Error("IDs created in a row aren't sorted.")
+	}
+	for _, id := range ids[:10] {
+		parsed, err := ParseID(id)
+		if err != nil || parsed.String() != id {
+			t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", parsed, err, id, nil))
+		}
+		if created := parsed.Time(); created.Before(before) || created.After(after) {
+			t.Error(fmt.Sprintf("Actual: %s\tExpected: between %s and %s", created, before, after))
+		}
+	}
+}
+
+// TestParseID tests that ParseID accepts UUIDv7s in any case and rejects everything else.
+func TestParseID(t *testing.T) {
+	valid := map[string]string{
+		"0161b891-1d85-7b4c-9133-da73a7113224": "0161b891-1d85-7b4c-9133-da73a7113224",
+		"0161B891-1D85-7B4C-9133-DA73A7113224": "0161b891-1d85-7b4c-9133-da73a7113224",
+	}
+	for in, expected := range valid {
+		actual, err := ParseID(in)
+		if err != nil || string(actual) != expected {
+			t.Error(fmt.Sprintf("Actual: %s - %v\tExpected: %s - %v", actual, err, expected, nil))
+		}
+	}
+	invalid := []string{
+		"",
+		"5a8d75057d9b53706595116a",             // An ObjectId.
+		"0161b891-1d85-4b4c-9133-da73a7113224", // A UUIDv4.
+		"0161b891-1d85-7b4c-c133-da73a7113224", // Wrong variant.
+		"0161b8911d857b4c9133da73a7113224abcd", // No hyphens.
+		"0161b891-1d85-7b4c-9133-da73a711322g", // Not hex.
+		"orange",
+	}
+	for _, in := range invalid {
+		if _, err := ParseID(in); err != ErrBadID {
+			t.Error(fmt.Sprintf("%q: Actual: %v\tExpected: %v", in, err, ErrBadID))
+		}
+	}
+	at := time.Date(2018, 2, 21, 13, 32, 53, 509000000, time.UTC)
+	if actual := NewIDAt(at).Time(); !actual.Equal(at) {
+		t.Error(fmt.Sprintf("Actual: %s\tExpected: %s", actual, at))
+	}
+}
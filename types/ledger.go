@@ -0,0 +1,40 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Reasons a budget can change, as found in LedgerEntry.Reason.
+const (
+	ReasonOpen   = "open"   // The user signed up, or had a budget from before there was a ledger.
+	ReasonSend   = "send"   // The user sent a message.
+	ReasonRefund = "refund" // A send failed after the user had been charged for it.
+	ReasonRefill = "refill" // The budget policy topped the budget up.
+	ReasonGrant  = "grant"  // An admin gave or took away budget by hand.
+)
+
+// LedgerEntry is a change to a user's budget. Entries are never changed once written, so a user's entries always add up to their budget.
+type LedgerEntry struct {
+	ID        ID        `json:"id"                  bson:"_id"`                 // The unique indentifier of the object. Read only.
+	UserID    ID        `json:"userId"              bson:"userId"`              // The user whose budget changed. It's the ID rather than the username, so entries survive renames.
+	Amount    int       `json:"amount"              bson:"amount"`              // How much the budget changed by. Negative when it went down.
+	Balance   int       `json:"balance"             bson:"balance"`             // The budget right after the change.
+	Reason    string    `json:"reason"              bson:"reason"`              // Why the budget changed: open, send, refund, refill, or grant.
+	MessageID ID        `json:"messageId,omitempty" bson:"messageId,omitempty"` // The message the change was for, for sends and refunds.
+	Note      string    `json:"note,omitempty"      bson:"note,omitempty"`      // What the admin said the change was for, for grants.
+	CreatedAt time.Time `json:"createdAt"           bson:"createdAt"`           // The UTC date and time of the change.
+}
+
+// MarshalJSON formats the createdAt field the same way as the times in User.
+func (e *LedgerEntry) MarshalJSON() ([]byte, error) {
+	type Alias LedgerEntry
+	utc, _ := time.LoadLocation("UTC")
+	return json.Marshal(&struct {
+		*Alias
+		CreatedAt string `json:"createdAt" bson:"createdAt"`
+	}{
+		Alias:     (*Alias)(e),
+		CreatedAt: e.CreatedAt.In(utc).Format("2006-01-02T15:04:05.999Z0700"),
+	})
+}
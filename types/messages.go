@@ -3,33 +3,101 @@ package types
 import (
 	"encoding/json"
 	"time"
-
-	"gopkg.in/mgo.v2/bson"
 )
 
-// Messages is a slice of Message.
+// Messages is a page of a message listing.
 type Messages struct {
-	Entries []Message `json:"messages" bson:"messages"`
+	Entries []Message `json:"messages"         bson:"messages"`
+	Next    string    `json:"next,omitempty"   bson:"next,omitempty"`   // The cursor for the next page. Blank on the last one.
+	Unread  *int      `json:"unread,omitempty" bson:"unread,omitempty"` // How many messages the recipient hasn't read yet, all pages included. Only in inbox listings.
 }
 
 // Message contains the message fields as per specification.
 type Message struct {
-	ID     bson.ObjectId `json:"id"      bson:"_id,omitempty"` // The unique indentifier of the object. Read only.
-	From   string        `json:"from"    bson:"from"`          // The sender user id.
-	To     string        `json:"to"      bson:"to"`            // The recipient user id.
-	Body   string        `json:"body"    bson:"body"`          // The message body content. Length: 1–280.
-	SentAt time.Time     `json:"sentAt"  bson:"sentAt"`        // The UTC date and time message was sent. Read only.
+	ID          ID         `json:"id"                    bson:"_id,omitempty"`         // The unique indentifier of the object. Read only.
+	From        string     `json:"from"                  bson:"from"`                  // The sender user id.
+	To          string     `json:"to"                    bson:"to"`                    // The recipient user id.
+	Body        string     `json:"body"                  bson:"body"`                  // The message body content. Length: 1–280.
+	Priority    string     `json:"priority,omitempty"    bson:"priority,omitempty"`    // How urgent the message is: normal or high. Missing means normal.
+	Cost        int        `json:"cost"                  bson:"cost"`                  // What the sender was charged for the message. Read only.
+	SentAt      time.Time  `json:"sentAt"                bson:"sentAt"`                // The UTC date and time message was sent. Read only.
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"` // The UTC date and time the message first showed up in the recipient's inbox listing. Read only.
+	ReadAt      *time.Time `json:"readAt,omitempty"      bson:"readAt,omitempty"`      // The UTC date and time the recipient read the message. Missing while unread. Read only.
+	ReplyTo     ID         `json:"replyTo,omitempty"     bson:"replyTo,omitempty"`     // The ID of the message this one replies to, if any. It has to be one the sender sent or received.
+	EditedAt    *time.Time `json:"editedAt,omitempty"    bson:"editedAt,omitempty"`    // The UTC date and time the sender last edited the message. Missing if they never did. Read only.
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"   bson:"deletedAt,omitempty"`   // The UTC date and time the sender deleted the message, leaving only a tombstone with no body. Read only.
+	Revisions   []Revision `json:"revisions,omitempty"   bson:"revisions,omitempty"`   // The bodies the message had before its last edit, oldest first. Read only.
+}
+
+// Priorities a message can have, as found in Message.Priority.
+const (
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// Quote is what a message would cost to send.
+type Quote struct {
+	Cost int `json:"cost"`
+}
+
+// Revision is a body a message had before it was edited.
+type Revision struct {
+	Body      string    `json:"body"      bson:"body"`
+	WrittenAt time.Time `json:"writtenAt" bson:"writtenAt"` // When the message got this body: when it was sent, for the first revision, or else when it was edited.
+}
+
+// Thread is a message along with its replies, and their replies, and so on.
+type Thread struct {
+	Message   Message   `json:"message"`
+	Replies   []*Thread `json:"replies"`             // Oldest first.
+	Truncated bool      `json:"truncated,omitempty"` // Some replies were left out, because the whole thread was too big.
 }
 
-// MarshalJSON is a hack to hijack JSON encoding for this type and format the sentAt field as per specification.
+// Conversation sums up the messages between a user and someone else.
+type Conversation struct {
+	With   string  `json:"with"        bson:"_id"`    // The other user's username.
+	Last   Message `json:"lastMessage" bson:"last"`   // The most recent message between them, either way.
+	Unread int     `json:"unread"      bson:"unread"` // How many messages from them the user hasn't read yet.
+}
+
+// MarshalJSON is a hack to hijack JSON encoding for this type and format the sentAt, deliveredAt, readAt, editedAt, and deletedAt fields as per specification.
 func (u *Message) MarshalJSON() ([]byte, error) {
 	type Alias Message
 	utc, _ := time.LoadLocation("UTC")
+	// The optional ones stay out when they're missing.
+	optional := func(t *time.Time) *string {
+		if t == nil {
+			return nil
+		}
+		formatted := t.In(utc).Format("2006-01-02T15:04:05.999Z0700")
+		return &formatted
+	}
+	return json.Marshal(&struct {
+		*Alias
+		SentAt      string  `json:"sentAt"  bson:"sentAt"`
+		DeliveredAt *string `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+		ReadAt      *string `json:"readAt,omitempty" bson:"readAt,omitempty"`
+		EditedAt    *string `json:"editedAt,omitempty" bson:"editedAt,omitempty"`
+		DeletedAt   *string `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	}{
+		Alias:       (*Alias)(u),
+		SentAt:      u.SentAt.In(utc).Format("2006-01-02T15:04:05.999Z0700"),
+		DeliveredAt: optional(u.DeliveredAt),
+		ReadAt:      optional(u.ReadAt),
+		EditedAt:    optional(u.EditedAt),
+		DeletedAt:   optional(u.DeletedAt),
+	})
+}
+
+// MarshalJSON formats the writtenAt field the same way as the times in Message.
+func (r *Revision) MarshalJSON() ([]byte, error) {
+	type Alias Revision
+	utc, _ := time.LoadLocation("UTC")
 	return json.Marshal(&struct {
 		*Alias
-		SentAt string `json:"sentAt"  bson:"sentAt"`
+		WrittenAt string `json:"writtenAt" bson:"writtenAt"`
 	}{
-		Alias:  (*Alias)(u),
-		SentAt: u.SentAt.In(utc).Format("2006-01-02T15:04:05.999Z0700"),
+		Alias:     (*Alias)(r),
+		WrittenAt: r.WrittenAt.In(utc).Format("2006-01-02T15:04:05.999Z0700"),
 	})
 }
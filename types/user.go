@@ -3,31 +3,43 @@ package types
 import (
 	"encoding/json"
 	"time"
-
-	"gopkg.in/mgo.v2/bson"
 )
 
 // User contains the user fields as per specification.
 type User struct {
-	ID        bson.ObjectId `json:"id"        bson:"_id,omitempty"` // The unique indentifier of the object. Read only.
-	Budget    int           `json:"budget"    bson:"budget"`        // The remaining budget to send messages. Read only.
-	Name      string        `json:"name"      bson:"name"`          // The human readable name of the user.
-	Username  string        `json:"username"  bson:"username"`      // The unique name of the user. '^[a-z][a-z_\.\-0-9]*$'.
-	CreatedAt time.Time     `json:"createdAt" bson:"createdAt"`     // The UTC date and time user has been created. Read only.
-	UpdatedAt time.Time     `json:"updatedAt" bson:"updatedAt"`     // The UTC date and time user has been updated. Read only.
+	ID             ID         `json:"id"        bson:"_id,omitempty"`                           // The unique indentifier of the object. Read only.
+	Budget         int        `json:"budget"    bson:"budget"`                                  // The remaining budget to send messages. Read only.
+	BudgetResetsAt *time.Time `json:"budgetResetsAt,omitempty" bson:"budgetResetsAt,omitempty"` // The UTC date and time the budget next fills back up. Missing if it won't. Read only.
+	Plan           string     `json:"plan,omitempty" bson:"plan,omitempty"`                     // The plan the user is on, which decides what budget they start with. Only admins can pick one.
+	Name           string     `json:"name"      bson:"name"`                                    // The human readable name of the user.
+	Username       string     `json:"username"  bson:"username"`                                // The unique name of the user. '^[a-z][a-z_\.\-0-9]*$'.
+	CreatedAt      time.Time  `json:"createdAt" bson:"createdAt"`                               // The UTC date and time user has been created. Read only.
+	UpdatedAt      time.Time  `json:"updatedAt" bson:"updatedAt"`                               // The UTC date and time user has been updated. Read only.
+	DeactivatedAt  *time.Time `json:"deactivatedAt,omitempty" bson:"deactivatedAt,omitempty"`   // The UTC date and time the user deactivated their account. Deactivated users can't send or receive messages. Read only.
 }
 
-// MarshalJSON is a hack to hijack JSON encoding for this type and format the createdAt and updatedAt fields as per specification.
+// MarshalJSON is a hack to hijack JSON encoding for this type and format the budgetResetsAt, createdAt, updatedAt, and deactivatedAt fields as per specification.
 func (u *User) MarshalJSON() ([]byte, error) {
 	type Alias User
 	utc, _ := time.LoadLocation("UTC")
-	return json.Marshal(&struct {
+	formatted := &struct {
 		*Alias
-		CreatedAt string `json:"createdAt" bson:"createdAt"`
-		UpdatedAt string `json:"updatedAt" bson:"updatedAt"`
+		BudgetResetsAt *string `json:"budgetResetsAt,omitempty" bson:"budgetResetsAt,omitempty"`
+		CreatedAt      string  `json:"createdAt" bson:"createdAt"`
+		UpdatedAt      string  `json:"updatedAt" bson:"updatedAt"`
+		DeactivatedAt  *string `json:"deactivatedAt,omitempty" bson:"deactivatedAt,omitempty"`
 	}{
 		Alias:     (*Alias)(u),
 		CreatedAt: u.CreatedAt.In(utc).Format("2006-01-02T15:04:05.999Z0700"),
 		UpdatedAt: u.UpdatedAt.In(utc).Format("2006-01-02T15:04:05.999Z0700"),
-	})
+	}
+	if u.BudgetResetsAt != nil {
+		resets := u.BudgetResetsAt.In(utc).Format("2006-01-02T15:04:05.999Z0700")
+		formatted.BudgetResetsAt = &resets
+	}
+	if u.DeactivatedAt != nil {
+		deactivated := u.DeactivatedAt.In(utc).Format("2006-01-02T15:04:05.999Z0700")
+		formatted.DeactivatedAt = &deactivated
+	}
+	return json.Marshal(formatted)
 }